@@ -0,0 +1,441 @@
+package remotestore
+
+import (
+	linked "container/list"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	cid "github.com/ipfs/go-cid"
+)
+
+// CachePolicy decides which blocks read from the source Remotestore.Get
+// copies to the main blockstore, and when those copies are evicted. A
+// policy only accounts for the blocks it admitted, or was seeded with as a
+// CacheSeeder, the other blocks of the main blockstore are never evicted. Since the blocks read from the source
+// are the leaves referenced by the RemoteManager, an evicted copy can
+// always be read again. Implementations must be safe for concurrent use.
+type CachePolicy interface {
+	// Admit is called with a block of size bytes read from the source. It
+	// reports whether to cache it, and returns the cached blocks to evict.
+	Admit(c cid.Cid, size int) (bool, []cid.Cid)
+
+	// Hit is called when a block is served from the main blockstore. It
+	// reports whether the cached copy is still valid, a stale copy is
+	// evicted and the block read from the source again.
+	Hit(c cid.Cid) bool
+
+	// Forget is called when a block is removed from the main blockstore.
+	Forget(c cid.Cid)
+}
+
+// CacheSeeder is implemented by the policies which account for the copies
+// cached before the Remotestore was created, e.g. by a previous run.
+// NewRemotestore seeds the policy with them, oldest first, before it serves
+// anything. The copies of the other policies are left to TrimCache.
+type CacheSeeder interface {
+	// Seed is called with a copy in the main blockstore. It returns the
+	// cached blocks to evict, b included if the policy doesn't keep it.
+	Seed(b CachedBlock) []cid.Cid
+}
+
+// seedAdmit seeds p with b as if it was just read from the source.
+func seedAdmit(p CachePolicy, b CachedBlock) []cid.Cid {
+	admit, evicted := p.Admit(b.Cid, b.Size)
+	if !admit {
+		evicted = append(evicted, b.Cid)
+	}
+	return evicted
+}
+
+// WithCachePolicy sets the policy caching the remote blocks read by Get,
+// AlwaysCache by default.
+func WithCachePolicy(p CachePolicy) Option {
+	return func(f *Remotestore) {
+		f.cache = p
+	}
+}
+
+type alwaysCache struct{}
+
+// AlwaysCache caches every block read from the source and never evicts
+// them.
+func AlwaysCache() CachePolicy {
+	return alwaysCache{}
+}
+
+func (alwaysCache) Admit(cid.Cid, int) (bool, []cid.Cid) { return true, nil }
+func (alwaysCache) Hit(cid.Cid) bool                     { return true }
+func (alwaysCache) Forget(cid.Cid)                       {}
+
+type neverCache struct{}
+
+// NeverCache caches none of the blocks read from the source.
+func NeverCache() CachePolicy {
+	return neverCache{}
+}
+
+func (neverCache) Admit(cid.Cid, int) (bool, []cid.Cid) { return false, nil }
+func (neverCache) Hit(cid.Cid) bool                     { return true }
+func (neverCache) Forget(cid.Cid)                       {}
+
+type cacheEntry struct {
+	c    cid.Cid
+	size int64
+
+	// list is the list of arcCache holding the entry, and expires the
+	// deadline of a ttlCache entry.
+	list    *linked.List
+	expires time.Time
+}
+
+type lruCache struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	lru     *linked.List
+	entries map[cid.Cid]*linked.Element
+}
+
+// LRUCache caches the blocks read from the source up to limit bytes,
+// evicting the least recently used ones first.
+func LRUCache(limit int64) CachePolicy {
+	return &lruCache{
+		limit:   limit,
+		lru:     linked.New(),
+		entries: make(map[cid.Cid]*linked.Element),
+	}
+}
+
+func (p *lruCache) Admit(c cid.Cid, size int) (bool, []cid.Cid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if int64(size) > p.limit {
+		return false, nil
+	}
+	if e, ok := p.entries[c]; ok {
+		p.lru.MoveToFront(e)
+		return true, nil
+	}
+
+	p.entries[c] = p.lru.PushFront(&cacheEntry{c: c, size: int64(size)})
+	p.used += int64(size)
+
+	var evicted []cid.Cid
+	for p.used > p.limit {
+		oldest := entry(p.lru.Back())
+		p.remove(oldest.c)
+		evicted = append(evicted, oldest.c)
+	}
+	return true, evicted
+}
+
+func (p *lruCache) Hit(c cid.Cid) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[c]; ok {
+		p.lru.MoveToFront(e)
+	}
+	return true
+}
+
+func (p *lruCache) Seed(b CachedBlock) []cid.Cid {
+	return seedAdmit(p, b)
+}
+
+func (p *lruCache) Forget(c cid.Cid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.remove(c)
+}
+
+func (p *lruCache) remove(c cid.Cid) {
+	if e, ok := p.entries[c]; ok {
+		p.used -= p.lru.Remove(e).(*cacheEntry).size
+		delete(p.entries, c)
+	}
+}
+
+// arcCache is an adaptive replacement cache weighted by block size. t1 and
+// t2 hold the cached blocks seen once and more than once, b1 and b2 the
+// ghosts of the blocks evicted from them, and target is the share of the
+// limit given to t1.
+type arcCache struct {
+	mu             sync.Mutex
+	limit          int64
+	target         int64
+	t1, t2, b1, b2 *linked.List
+	sizes          map[*linked.List]int64
+	entries        map[cid.Cid]*linked.Element
+}
+
+// ARCCache caches the blocks read from the source up to limit bytes,
+// balancing the recently and the frequently used ones, so that a scan of
+// many blocks does not flush the ones read over and over.
+func ARCCache(limit int64) CachePolicy {
+	p := &arcCache{
+		limit:   limit,
+		t1:      linked.New(),
+		t2:      linked.New(),
+		b1:      linked.New(),
+		b2:      linked.New(),
+		entries: make(map[cid.Cid]*linked.Element),
+	}
+	p.sizes = map[*linked.List]int64{p.t1: 0, p.t2: 0, p.b1: 0, p.b2: 0}
+	return p
+}
+
+func (p *arcCache) Admit(c cid.Cid, size int) (bool, []cid.Cid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if int64(size) > p.limit {
+		return false, nil
+	}
+
+	var evicted []cid.Cid
+	if e, ok := p.entries[c]; ok {
+		ghost := entry(e)
+		switch ghost.list {
+		case p.t1, p.t2:
+			p.move(e, p.t2)
+			return true, nil
+		case p.b1:
+			p.target = min(p.limit, p.target+ghost.size*max(1, p.sizes[p.b2]/max(1, p.sizes[p.b1])))
+			evicted = p.replace(int64(size), false)
+		case p.b2:
+			p.target = max(0, p.target-ghost.size*max(1, p.sizes[p.b1]/max(1, p.sizes[p.b2])))
+			evicted = p.replace(int64(size), true)
+		}
+		p.remove(c)
+		p.push(c, int64(size), p.t2)
+		return true, evicted
+	}
+
+	evicted = p.replace(int64(size), false)
+	for p.sizes[p.t1]+p.sizes[p.b1]+int64(size) > p.limit && p.b1.Len() > 0 {
+		p.remove(entry(p.b1.Back()).c)
+	}
+	for p.sizes[p.t1]+p.sizes[p.t2]+p.sizes[p.b1]+p.sizes[p.b2]+int64(size) > 2*p.limit && p.b2.Len() > 0 {
+		p.remove(entry(p.b2.Back()).c)
+	}
+	p.push(c, int64(size), p.t1)
+	return true, evicted
+}
+
+// replace evicts cached blocks to the ghost lists until size bytes fit.
+func (p *arcCache) replace(size int64, inB2 bool) []cid.Cid {
+	var evicted []cid.Cid
+	for p.sizes[p.t1]+p.sizes[p.t2]+size > p.limit {
+		from, to := p.t2, p.b2
+		if t1 := p.sizes[p.t1]; p.t1.Len() > 0 && (t1 > p.target || (inB2 && t1 == p.target) || p.t2.Len() == 0) {
+			from, to = p.t1, p.b1
+		}
+		e := from.Back()
+		evicted = append(evicted, entry(e).c)
+		p.move(e, to)
+	}
+	return evicted
+}
+
+func (p *arcCache) push(c cid.Cid, size int64, to *linked.List) {
+	p.entries[c] = to.PushFront(&cacheEntry{c: c, size: size, list: to})
+	p.sizes[to] += size
+}
+
+func (p *arcCache) move(e *linked.Element, to *linked.List) {
+	moved := entry(e)
+	p.remove(moved.c)
+	p.push(moved.c, moved.size, to)
+}
+
+func (p *arcCache) remove(c cid.Cid) {
+	if e, ok := p.entries[c]; ok {
+		removed := entry(e)
+		removed.list.Remove(e)
+		p.sizes[removed.list] -= removed.size
+		delete(p.entries, c)
+	}
+}
+
+func (p *arcCache) Hit(c cid.Cid) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[c]; ok {
+		if l := entry(e).list; l == p.t1 || l == p.t2 {
+			p.move(e, p.t2)
+		}
+	}
+	return true
+}
+
+// contains reports whether c is cached, which counts as a hit.
+func (p *arcCache) contains(c cid.Cid) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[c]
+	if !ok {
+		return false
+	}
+	if l := entry(e).list; l == p.t1 || l == p.t2 {
+		p.move(e, p.t2)
+		return true
+	}
+	return false
+}
+
+func (p *arcCache) Seed(b CachedBlock) []cid.Cid {
+	return seedAdmit(p, b)
+}
+
+func (p *arcCache) Forget(c cid.Cid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[c]; ok {
+		if l := entry(e).list; l == p.t1 || l == p.t2 {
+			p.remove(c)
+		}
+	}
+}
+
+func entry(e *linked.Element) *cacheEntry {
+	return e.Value.(*cacheEntry)
+}
+
+type ttlCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	order   *linked.List
+	entries map[cid.Cid]*linked.Element
+}
+
+// TTLCache caches the blocks read from the source for ttl, after which they
+// are read from the source again.
+func TTLCache(ttl time.Duration) CachePolicy {
+	return &ttlCache{
+		ttl:     ttl,
+		now:     time.Now,
+		order:   linked.New(),
+		entries: make(map[cid.Cid]*linked.Element),
+	}
+}
+
+func (p *ttlCache) Admit(c cid.Cid, size int) (bool, []cid.Cid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.remove(c)
+	p.entries[c] = p.order.PushBack(&cacheEntry{c: c, size: int64(size), expires: now.Add(p.ttl)})
+
+	// the entries expire in the order they were admitted
+	var evicted []cid.Cid
+	for e := p.order.Front(); e != nil && !now.Before(entry(e).expires); e = p.order.Front() {
+		evicted = append(evicted, entry(e).c)
+		p.remove(entry(e).c)
+	}
+	return true, evicted
+}
+
+func (p *ttlCache) Hit(c cid.Cid) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[c]
+	if !ok {
+		return true
+	}
+	if p.now().Before(entry(e).expires) {
+		return true
+	}
+	p.remove(c)
+	return false
+}
+
+// Seed keeps b until ttl after it was cached.
+func (p *ttlCache) Seed(b CachedBlock) []cid.Cid {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expires := b.Cached.Add(p.ttl)
+	p.remove(b.Cid)
+	if !p.now().Before(expires) {
+		return []cid.Cid{b.Cid}
+	}
+	p.entries[b.Cid] = p.order.PushBack(&cacheEntry{c: b.Cid, size: int64(b.Size), expires: expires})
+	return nil
+}
+
+func (p *ttlCache) Forget(c cid.Cid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.remove(c)
+}
+
+func (p *ttlCache) remove(c cid.Cid) {
+	if e, ok := p.entries[c]; ok {
+		p.order.Remove(e)
+		delete(p.entries, c)
+	}
+}
+
+// frequentTracked bounds the number of blocks FrequentCache counts the
+// reads of.
+const frequentTracked = 1 << 16
+
+type frequentCache struct {
+	mu    sync.Mutex
+	n     int
+	reads *simplelru.LRU[cid.Cid, int]
+	next  CachePolicy
+}
+
+// FrequentCache caches the blocks read from the source more than n times,
+// leaving the accounting and eviction of the cached ones to next.
+func FrequentCache(n int, next CachePolicy) CachePolicy {
+	reads, _ := simplelru.NewLRU[cid.Cid, int](frequentTracked, nil)
+	return &frequentCache{
+		n:     n,
+		reads: reads,
+		next:  next,
+	}
+}
+
+func (p *frequentCache) Admit(c cid.Cid, size int) (bool, []cid.Cid) {
+	p.mu.Lock()
+	reads, _ := p.reads.Get(c)
+	reads++
+	if reads <= p.n {
+		p.reads.Add(c, reads)
+		p.mu.Unlock()
+		return false, nil
+	}
+	p.reads.Remove(c)
+	p.mu.Unlock()
+
+	return p.next.Admit(c, size)
+}
+
+func (p *frequentCache) Hit(c cid.Cid) bool {
+	return p.next.Hit(c)
+}
+
+// Seed seeds next, the cached blocks were read often enough.
+func (p *frequentCache) Seed(b CachedBlock) []cid.Cid {
+	if s, ok := p.next.(CacheSeeder); ok {
+		return s.Seed(b)
+	}
+	return nil
+}
+
+func (p *frequentCache) Forget(c cid.Cid) {
+	p.next.Forget(c)
+}
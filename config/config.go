@@ -0,0 +1,207 @@
+// Package config builds a Remotestore stack from a declarative description
+// of its sources, credentials and cache policy.
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+	"github.com/Dreamacro/go-ds-remote/mount"
+	"github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/samber/oops"
+	"gopkg.in/yaml.v3"
+
+	// built-in sources
+	_ "github.com/Dreamacro/go-ds-remote/file"
+	_ "github.com/Dreamacro/go-ds-remote/http"
+	_ "github.com/Dreamacro/go-ds-remote/s3"
+)
+
+// Cache policies.
+const (
+	CacheAlways = "always"
+	CacheNever  = "never"
+	CacheLRU    = "lru"
+	CacheARC    = "arc"
+	CacheTTL    = "ttl"
+)
+
+type Config struct {
+	Mounts []Mount `json:"mounts" yaml:"mounts"`
+
+	// Credentials are referenced by name from mounts. Environment variables
+	// in their values, like `${AWS_SECRET_ACCESS_KEY}`, are expanded.
+	Credentials map[string]rs.Credential `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+
+	Cache Cache `json:"cache" yaml:"cache"`
+}
+
+type Mount struct {
+	// Prefix of the keys served by the source, `/` if omitted.
+	Prefix string `json:"prefix" yaml:"prefix"`
+
+	// URI of the source, its scheme selects the registered source type.
+	URI string `json:"uri" yaml:"uri"`
+
+	// Credentials is the name of an entry of Config.Credentials.
+	Credentials string `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+}
+
+type Cache struct {
+	// default is `always`
+	Policy string `json:"policy" yaml:"policy"`
+
+	// Size in bytes of the `lru` and `arc` policies.
+	Size int64 `json:"size,omitempty" yaml:"size,omitempty"`
+
+	// TTL of the `ttl` policy, like `10m`.
+	TTL string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+
+	// MinReads, when set, restricts the policy to the blocks read more
+	// than MinReads times.
+	MinReads int `json:"min_reads,omitempty" yaml:"min_reads,omitempty"`
+}
+
+// CachePolicy returns the cache policy described by c.
+func (c Cache) CachePolicy() (rs.CachePolicy, error) {
+	var policy rs.CachePolicy
+	switch c.Policy {
+	case CacheAlways, "":
+		policy = rs.AlwaysCache()
+	case CacheNever:
+		return rs.NeverCache(), nil
+	case CacheLRU, CacheARC:
+		if c.Size <= 0 {
+			return nil, oops.Errorf("cache policy %q requires a size", c.Policy)
+		}
+		policy = rs.LRUCache(c.Size)
+		if c.Policy == CacheARC {
+			policy = rs.ARCCache(c.Size)
+		}
+	case CacheTTL:
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, oops.Errorf("invalid cache ttl %q", c.TTL)
+		}
+		policy = rs.TTLCache(ttl)
+	default:
+		return nil, oops.Errorf("unknown cache policy %q", c.Policy)
+	}
+
+	if c.MinReads > 0 {
+		policy = rs.FrequentCache(c.MinReads, policy)
+	}
+	return policy, nil
+}
+
+// Parse decodes a JSON config. Since JSON is a subset of YAML, use
+// ParseYAML to accept both.
+func Parse(data []byte) (*Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, oops.Wrapf(err, "failed to parse config")
+	}
+	return &cfg, nil
+}
+
+// ParseYAML decodes a YAML config.
+func ParseYAML(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, oops.Wrapf(err, "failed to parse config")
+	}
+	return &cfg, nil
+}
+
+// Load reads a config file, as YAML if its extension is `.yaml` or `.yml`
+// and as JSON otherwise.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, oops.Wrapf(err, "failed to read config")
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ParseYAML(data)
+	default:
+		return Parse(data)
+	}
+}
+
+// Source builds the source described by the mounts of the config. A single
+// mount at `/` is returned as is, otherwise the sources are combined in a
+// mount.Source.
+func (c *Config) Source(ctx context.Context) (rs.RemoteSource, error) {
+	if len(c.Mounts) == 0 {
+		return nil, oops.Errorf("no mount configured")
+	}
+
+	mounts := make([]mount.Mount, 0, len(c.Mounts))
+	for _, m := range c.Mounts {
+		var cred *rs.Credential
+		if m.Credentials != "" {
+			v, ok := c.Credentials[m.Credentials]
+			if !ok {
+				return nil, oops.Errorf("unknown credentials %q", m.Credentials)
+			}
+			cred = &rs.Credential{
+				AccessKeyID:     os.ExpandEnv(v.AccessKeyID),
+				SecretAccessKey: os.ExpandEnv(v.SecretAccessKey),
+				SessionToken:    os.ExpandEnv(v.SessionToken),
+			}
+		}
+
+		source, err := rs.OpenSource(ctx, m.URI, cred)
+		if err != nil {
+			return nil, err
+		}
+
+		mounts = append(mounts, mount.Mount{
+			Prefix:    ds.NewKey(m.Prefix),
+			Datastore: source,
+		})
+	}
+
+	if len(mounts) == 1 && mounts[0].Prefix.Equal(ds.NewKey("/")) {
+		return mounts[0].Datastore, nil
+	}
+
+	return mount.New(mounts), nil
+}
+
+// Options returns the Remotestore options described by the config.
+func (c *Config) Options() ([]rs.Option, error) {
+	var opts []rs.Option
+
+	policy, err := c.Cache.CachePolicy()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, rs.WithCachePolicy(policy))
+
+	return opts, nil
+}
+
+// Build builds the whole Remotestore stack described by the config. The
+// references are stored in d, and the regular blocks in bs.
+func (c *Config) Build(ctx context.Context, bs blockstore.Blockstore, d ds.Batching) (*rs.Remotestore, error) {
+	source, err := c.Source(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+
+	fm := rs.NewRemoteManager(d, source)
+	return rs.NewRemotestore(bs, fm, opts...), nil
+}
@@ -0,0 +1,225 @@
+package config_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+	"github.com/Dreamacro/go-ds-remote/config"
+	"github.com/Dreamacro/go-ds-remote/mount"
+	"github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+)
+
+type echoSource struct {
+	host string
+	cred *rs.Credential
+}
+
+func (s *echoSource) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(s.host + key)), nil
+}
+
+func (s *echoSource) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
+	return io.NopCloser(strings.NewReader(s.host + key)), uint64(len(s.host + key)), nil
+}
+
+func init() {
+	rs.RegisterSource("echo", func(ctx context.Context, u *url.URL, cred *rs.Credential) (rs.RemoteSource, error) {
+		return &echoSource{host: u.Host, cred: cred}, nil
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	require.Subset(t, rs.Schemes(), []string{"echo", "file", "http", "https", "s3"})
+
+	require.Panics(t, func() {
+		rs.RegisterSource("echo", func(ctx context.Context, u *url.URL, cred *rs.Credential) (rs.RemoteSource, error) {
+			return nil, nil
+		})
+	})
+
+	_, err := rs.OpenSource(context.Background(), "unknown://foo", nil)
+	require.Error(t, err)
+}
+
+func TestConfig_Mounts(t *testing.T) {
+	t.Setenv("ECHO_SECRET", "secret")
+
+	cfg, err := config.ParseYAML([]byte(`
+mounts:
+  - prefix: /foo
+    uri: echo://foo
+    credentials: echo
+  - prefix: /bar
+    uri: echo://bar
+credentials:
+  echo:
+    access_key_id: key
+    secret_access_key: ${ECHO_SECRET}
+`))
+	require.NoError(t, err)
+
+	source, err := cfg.Source(context.Background())
+	require.NoError(t, err)
+	require.IsType(t, &mount.Source{}, source)
+
+	mounts := source.(*mount.Source).Mounts()
+	require.Len(t, mounts, 2)
+	require.Equal(t, "/foo", mounts[0].Prefix.String())
+	require.Equal(t, &rs.Credential{AccessKeyID: "key", SecretAccessKey: "secret"}, mounts[0].Datastore.(*echoSource).cred)
+	require.Nil(t, mounts[1].Datastore.(*echoSource).cred)
+
+	r, err := source.GetPart(context.Background(), "/bar/baz", 0, 0)
+	require.NoError(t, err)
+	v, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "bar/baz", string(v))
+
+	cfg.Mounts[0].Credentials = "missing"
+	_, err = cfg.Source(context.Background())
+	require.Error(t, err)
+
+	cfg.Mounts = nil
+	_, err = cfg.Source(context.Background())
+	require.Error(t, err)
+}
+
+func TestConfig_Build(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	data := bytes.Repeat([]byte("A"), 1024)
+	fname := filepath.Join(dir, "foo")
+	require.NoError(t, os.WriteFile(fname, data, 0o644))
+
+	cfgPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(cfgPath, []byte(`{
+		"mounts": [{"prefix": "/", "uri": "file://`+filepath.ToSlash(dir)+`"}],
+		"cache": {"policy": "never"}
+	}`), 0o644))
+
+	cfg, err := config.Load(cfgPath)
+	require.NoError(t, err)
+
+	mds := ds.NewMapDatastore()
+	bs := blockstore.NewBlockstore(mds)
+	store, err := cfg.Build(ctx, bs, mds)
+	require.NoError(t, err)
+
+	node, err := store.SyncIndex(ctx, fname, rs.SyncIndexOptions{})
+	require.NoError(t, err)
+
+	block, err := store.Get(ctx, node.Cid())
+	require.NoError(t, err)
+	require.Equal(t, data, block.RawData())
+
+	// the cache policy is never
+	has, err := bs.Has(ctx, node.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	cfg.Cache.Policy = "sometimes"
+	_, err = cfg.Build(ctx, bs, mds)
+	require.Error(t, err)
+}
+
+func TestConfig_HTTP(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	data := make([]byte, 4*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "files"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "files", "foo"), data, 0o644))
+
+	files := http.FileServer(http.Dir(dir))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "key" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	cfg, err := config.ParseYAML([]byte(`
+mounts:
+  - prefix: /web
+    uri: ` + srv.URL + `/files
+    credentials: web
+credentials:
+  web:
+    access_key_id: key
+    secret_access_key: secret
+cache:
+  policy: never
+`))
+	require.NoError(t, err)
+
+	mds := ds.NewMapDatastore()
+	store, err := cfg.Build(ctx, blockstore.NewBlockstore(mds), mds)
+	require.NoError(t, err)
+
+	node, err := store.SyncIndex(ctx, "/web/foo", rs.SyncIndexOptions{Chunker: "size-1024"})
+	require.NoError(t, err)
+
+	// the leaves are read back with ranged requests
+	require.Len(t, node.Links(), 4)
+	for i, l := range node.Links() {
+		block, err := store.Get(ctx, l.Cid)
+		require.NoError(t, err)
+		require.Equal(t, data[i*1024:(i+1)*1024], block.RawData())
+	}
+
+	// the fingerprint comes from the headers
+	info, err := store.RemoteManager().ObjectInfo(ctx, "/web/foo")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), info.Size)
+	require.False(t, info.ModTime.IsZero())
+
+	_, err = store.SyncIndex(ctx, "/web/missing", rs.SyncIndexOptions{})
+	var cerr *rs.CorruptReferenceError
+	require.ErrorAs(t, err, &cerr)
+	require.Equal(t, rs.StatusFileNotFound, cerr.Code)
+
+	// the requests without credential are refused
+	source, err := rs.OpenSource(ctx, srv.URL+"/files", nil)
+	require.NoError(t, err)
+	_, _, err = source.Get(ctx, "foo")
+	require.Error(t, err)
+}
+
+func TestConfig_CachePolicy(t *testing.T) {
+	for _, c := range []config.Cache{
+		{},
+		{Policy: config.CacheNever},
+		{Policy: config.CacheLRU, Size: 1 << 20},
+		{Policy: config.CacheARC, Size: 1 << 20, MinReads: 2},
+		{Policy: config.CacheTTL, TTL: "10m"},
+	} {
+		policy, err := c.CachePolicy()
+		require.NoError(t, err, c.Policy)
+		require.NotNil(t, policy)
+	}
+
+	for _, c := range []config.Cache{
+		{Policy: config.CacheLRU},
+		{Policy: config.CacheTTL, TTL: "soon"},
+		{Policy: "sometimes"},
+	} {
+		_, err := c.CachePolicy()
+		require.Error(t, err, c.Policy)
+	}
+}
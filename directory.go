@@ -0,0 +1,161 @@
+package remotestore
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/samber/oops"
+)
+
+// SyncEntry is the result of the sync of an object by SyncPrefix.
+type SyncEntry struct {
+	// Key is the key of the object, and Path its path in the directory.
+	Key  string
+	Path string
+
+	Node ipld.Node
+	Err  error
+}
+
+// SyncPrefix indexes every object of the source whose key starts with
+// prefix, and builds the UnixFS directories mirroring their keys after the
+// last slash of prefix. A directory switches to HAMT sharding once it
+// outgrows uio.HAMTShardingSize. It returns the root directory and the
+// result of each object, the objects which failed are left out of the
+// directories. The source must be a ListSource, and prefix is normalized
+// like a key up to its last slash.
+func (f *Remotestore) SyncPrefix(ctx context.Context, prefix string, opts SyncIndexOptions) (ipld.Node, []SyncEntry, error) {
+	ls, ok := f.fm.source.(ListSource)
+	if !ok {
+		return nil, nil, oops.Wrapf(ErrNotSupported, "source can't list objects")
+	}
+
+	builder, err := opts.cidBuilder()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	base, err := f.prefixBase(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	root := newDirTree()
+
+	var entries []SyncEntry
+	err = ls.List(ctx, prefix, func(key string) error {
+		entry := SyncEntry{Key: key, Path: strings.TrimPrefix(key, base)}
+		entry.Node, entry.Err = f.SyncIndex(ctx, key, opts)
+		if entry.Err == nil {
+			entry.Err = root.add(entry.Path, entry.Node)
+		}
+		entries = append(entries, entry)
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, entries, err
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(f, offline.Exchange(f)))
+	nd, err := root.build(ctx, dserv, builder)
+	if err != nil {
+		return nil, entries, oops.Wrapf(err, "failed to build directories")
+	}
+	return nd, entries, nil
+}
+
+// prefixBase returns the part of prefix up to its last slash, in the
+// normalized form of the keys the source lists.
+func (f *Remotestore) prefixBase(prefix string) (string, error) {
+	base := prefix[:strings.LastIndex(prefix, "/")+1]
+	if base == "" {
+		return "", nil
+	}
+
+	base, err := f.fm.NormalizeKey(base)
+	if err != nil {
+		return "", err
+	}
+	base = strings.TrimSuffix(base, "/")
+	if base == "" || base == "." {
+		return "", nil
+	}
+	return base + "/", nil
+}
+
+// dirTree is a directory of the key hierarchy.
+type dirTree struct {
+	dirs  map[string]*dirTree
+	files map[string]ipld.Node
+}
+
+func newDirTree() *dirTree {
+	return &dirTree{
+		dirs:  make(map[string]*dirTree),
+		files: make(map[string]ipld.Node),
+	}
+}
+
+// add adds the file nd at path, creating its parent directories.
+func (t *dirTree) add(path string, nd ipld.Node) error {
+	names := strings.Split(path, "/")
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." {
+			return oops.Errorf("invalid path %q", path)
+		}
+	}
+
+	dir := t
+	for _, name := range names[:len(names)-1] {
+		if _, ok := dir.files[name]; ok {
+			return oops.Errorf("path %q conflicts with file %s", path, name)
+		}
+		sub, ok := dir.dirs[name]
+		if !ok {
+			sub = newDirTree()
+			dir.dirs[name] = sub
+		}
+		dir = sub
+	}
+
+	name := names[len(names)-1]
+	if _, ok := dir.dirs[name]; ok {
+		return oops.Errorf("path %q conflicts with a directory", path)
+	}
+	dir.files[name] = nd
+	return nil
+}
+
+// build writes the directory nodes of t and returns its root.
+func (t *dirTree) build(ctx context.Context, dserv ipld.DAGService, builder cid.Builder) (ipld.Node, error) {
+	dir := uio.NewDirectory(dserv)
+	dir.SetCidBuilder(builder)
+
+	for _, name := range slices.Sorted(maps.Keys(t.dirs)) {
+		nd, err := t.dirs[name].build(ctx, dserv, builder)
+		if err != nil {
+			return nil, err
+		}
+		if err := dir.AddChild(ctx, name, nd); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(t.files)) {
+		if err := dir.AddChild(ctx, name, t.files[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	nd, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	return nd, dserv.Add(ctx, nd)
+}
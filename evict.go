@@ -0,0 +1,215 @@
+package remotestore
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// RemotestoreCachePrefix identifies the key prefix for the blocks of the
+// main blockstore which are cached copies of references.
+var RemotestoreCachePrefix = ds.NewKey("remotestore-cache")
+
+// CachedBlock is a block of the main blockstore copied from the source.
+type CachedBlock struct {
+	Cid    cid.Cid   `json:"-"`
+	Size   int       `json:"size"`
+	Cached time.Time `json:"cached"`
+}
+
+// CacheFilter selects the cached blocks to evict.
+type CacheFilter func(CachedBlock) bool
+
+func (f *RemoteManager) markCached(ctx context.Context, c cid.Cid, size int) error {
+	data, err := json.Marshal(CachedBlock{Size: size, Cached: time.Now()})
+	if err != nil {
+		return err
+	}
+	return f.cached.Put(ctx, dshelp.MultihashToDsKey(c.Hash()), data)
+}
+
+func (f *RemoteManager) unmarkCached(ctx context.Context, c cid.Cid) error {
+	return f.cached.Delete(ctx, dshelp.MultihashToDsKey(c.Hash()))
+}
+
+func (f *RemoteManager) isCached(ctx context.Context, c cid.Cid) (bool, error) {
+	return f.cached.Has(ctx, dshelp.MultihashToDsKey(c.Hash()))
+}
+
+// CachedBlocks returns the blocks of the main blockstore which are cached
+// copies of remote blocks, oldest first.
+func (f *Remotestore) CachedBlocks(ctx context.Context) ([]CachedBlock, error) {
+	qr, err := f.fm.cached.Query(ctx, dsq.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer qr.Close()
+
+	var out []CachedBlock
+	for {
+		r, ok := qr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		m, err := dshelp.DsKeyToMultihash(ds.RawKey(r.Key))
+		if err != nil {
+			logger.Errorf("decoding multihash from cache: %s", err)
+			continue
+		}
+
+		var b CachedBlock
+		if err := json.Unmarshal(r.Value, &b); err != nil {
+			logger.Errorf("decoding cached block %s: %s", r.Key, err)
+			continue
+		}
+		b.Cid = cid.NewCidV1(cid.Raw, m)
+		out = append(out, b)
+	}
+
+	slices.SortFunc(out, func(a, b CachedBlock) int {
+		return a.Cached.Compare(b.Cached)
+	})
+	return out, nil
+}
+
+// EvictCache removes the cached copies of remote blocks selected by filter,
+// or all of them if filter is nil, from the main blockstore. A copy whose
+// reference is gone is the only copy left of the block, it is kept as a
+// regular block instead. It returns the number of evicted blocks.
+func (f *Remotestore) EvictCache(ctx context.Context, filter CacheFilter) (int, error) {
+	cached, err := f.CachedBlocks(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, b := range cached {
+		if filter != nil && !filter(b) {
+			continue
+		}
+
+		evicted, err := f.evict(ctx, b.Cid)
+		if err != nil {
+			return count, err
+		}
+		if evicted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// TrimCache evicts the oldest cached copies of remote blocks until they
+// take at most limit bytes. It returns the number of evicted blocks.
+func (f *Remotestore) TrimCache(ctx context.Context, limit int64) (int, error) {
+	cached, err := f.CachedBlocks(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var used int64
+	for _, b := range cached {
+		used += int64(b.Size)
+	}
+
+	count := 0
+	for _, b := range cached {
+		if used <= limit {
+			break
+		}
+
+		evicted, err := f.evict(ctx, b.Cid)
+		if err != nil {
+			return count, err
+		}
+		if evicted {
+			count++
+		}
+		// a kept copy no longer counts as cached either
+		used -= int64(b.Size)
+	}
+	return count, nil
+}
+
+// RunCacheCleaner trims the cached copies of remote blocks to limit bytes
+// every interval, until ctx is done.
+func (f *Remotestore) RunCacheCleaner(ctx context.Context, limit int64, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := f.TrimCache(ctx, limit)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				logger.Errorf("trimming cache: %s", err)
+			} else if n > 0 {
+				logger.Debugf("evicted %d cached blocks", n)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// seedCache seeds the cache policy s with the copies cached before, and
+// evicts the ones it doesn't keep.
+func (f *Remotestore) seedCache(ctx context.Context, s CacheSeeder) {
+	cached, err := f.CachedBlocks(ctx)
+	if err != nil {
+		logger.Errorf("seeding the cache policy: %s", err)
+		return
+	}
+
+	for _, b := range cached {
+		for _, c := range s.Seed(b) {
+			if _, err := f.evict(ctx, c); err != nil {
+				logger.Errorf("evicting cached block %s: %s", c, err)
+			}
+		}
+	}
+}
+
+// evict removes the cached copy of c from the main blockstore, unless it
+// is no longer referenced. It reports whether the copy was removed.
+func (f *Remotestore) evict(ctx context.Context, c cid.Cid) (bool, error) {
+	f.cache.Forget(c)
+
+	has, err := f.remoteHas(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	if has {
+		if err := f.bs.DeleteBlock(ctx, c); err != nil && !ipld.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	return has, f.fm.unmarkCached(ctx, c)
+}
+
+// keep makes the cached copy of c, if any, a regular block of the main
+// blockstore.
+func (f *Remotestore) keep(ctx context.Context, c cid.Cid) error {
+	cached, err := f.fm.isCached(ctx, c)
+	if err != nil || !cached {
+		return err
+	}
+
+	f.cache.Forget(c)
+	return f.fm.unmarkCached(ctx, c)
+}
@@ -0,0 +1,77 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoot is returned for the paths resolving out of the root of a
+// Source.
+var ErrOutsideRoot = errors.New("file not in root path")
+
+// SymlinkPolicy defines how a Source handles the symlinks in the paths it
+// opens.
+type SymlinkPolicy int
+
+const (
+	// SymlinksBeneath follows the symlinks which resolve inside the root.
+	// On Linux, the kernel enforces it and absolute symlinks are refused.
+	SymlinksBeneath SymlinkPolicy = iota
+	// SymlinksDeny refuses the paths containing a symlink.
+	SymlinksDeny
+	// SymlinksFollow follows every symlink, even out of the root. Only the
+	// path itself is checked to be inside the root.
+	SymlinksFollow
+)
+
+// WithSymlinkPolicy sets how symlinks are handled, SymlinksBeneath by
+// default.
+func WithSymlinkPolicy(policy SymlinkPolicy) Option {
+	return func(s *Source) {
+		s.symlinks = policy
+	}
+}
+
+// openBeneathUser confines rel to root in userspace. It is used when the
+// kernel can't do it, and can be raced by concurrent renames in the root.
+func openBeneathUser(root, rel string, policy SymlinkPolicy) (*os.File, error) {
+	full := filepath.Join(root, rel)
+
+	switch policy {
+	case SymlinksFollow:
+	case SymlinksDeny:
+		cur := root
+		for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+			cur = filepath.Join(cur, elem)
+			fi, err := os.Lstat(cur)
+			if err != nil {
+				return nil, fileError(err)
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return nil, errOutsideRoot()
+			}
+		}
+	default:
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, fileError(err)
+		}
+		resolved, err := filepath.EvalSymlinks(full)
+		if err != nil {
+			return nil, fileError(err)
+		}
+		r, err := filepath.Rel(resolvedRoot, resolved)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			return nil, errOutsideRoot()
+		}
+		full = resolved
+	}
+
+	file, err := os.Open(full)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	return file, nil
+}
@@ -0,0 +1,55 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// noOpenat2 is set once openat2 turned out to be unavailable.
+var noOpenat2 atomic.Bool
+
+// openBeneath opens rel with openat2, so that the kernel refuses to resolve
+// it out of root.
+func openBeneath(root, rel string, policy SymlinkPolicy) (*os.File, error) {
+	if policy == SymlinksFollow || noOpenat2.Load() {
+		return openBeneathUser(root, rel, policy)
+	}
+
+	dir, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fileError(&os.PathError{Op: "open", Path: root, Err: err})
+	}
+	defer unix.Close(dir)
+
+	how := unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	if policy == SymlinksDeny {
+		how.Resolve |= unix.RESOLVE_NO_SYMLINKS
+	}
+
+	var fd int
+	for range 3 {
+		fd, err = unix.Openat2(dir, rel, &how)
+		// EAGAIN is returned when a rename raced the resolution
+		if err != unix.EAGAIN && err != unix.EINTR {
+			break
+		}
+	}
+
+	switch {
+	case err == nil:
+		return os.NewFile(uintptr(fd), filepath.Join(root, rel)), nil
+	case err == unix.ENOSYS:
+		noOpenat2.Store(true)
+		return openBeneathUser(root, rel, policy)
+	case err == unix.EXDEV, err == unix.ELOOP && policy == SymlinksDeny:
+		return nil, errOutsideRoot()
+	default:
+		return nil, fileError(&os.PathError{Op: "openat2", Path: filepath.Join(root, rel), Err: err})
+	}
+}
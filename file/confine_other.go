@@ -0,0 +1,9 @@
+//go:build !linux
+
+package file
+
+import "os"
+
+func openBeneath(root, rel string, policy SymlinkPolicy) (*os.File, error) {
+	return openBeneathUser(root, rel, policy)
+}
@@ -0,0 +1,150 @@
+package file
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+)
+
+func setupConfineTest(t *testing.T) (string, string) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+
+	for _, dir := range []string{root, outside, filepath.Join(root, "sub")} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string]string{
+		filepath.Join(root, "a..b"):          "dots",
+		filepath.Join(root, "sub", "inside"): "inside",
+		filepath.Join(outside, "secret"):     "secret",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "rel-inside"):  filepath.Join("sub", "inside"),
+		filepath.Join(root, "rel-escape"):  filepath.Join("..", "outside", "secret"),
+		filepath.Join(root, "abs-escape"):  filepath.Join(outside, "secret"),
+		filepath.Join(root, "dir-escape"):  outside,
+		filepath.Join(root, "sub", "up"):   "..",
+		filepath.Join(root, "sub", "loop"): "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Skip("symlinks not supported: ", err)
+		}
+	}
+
+	return root, outside
+}
+
+func TestConfinement(t *testing.T) {
+	root, outside := setupConfineTest(t)
+
+	const (
+		ok = iota
+		escape
+		fail
+	)
+
+	cases := []struct {
+		path    string
+		beneath int
+		deny    int
+		follow  int
+	}{
+		{"a..b", ok, ok, ok},
+		{filepath.Join("sub", "inside"), ok, ok, ok},
+		{filepath.Join("sub", "..", "a..b"), ok, ok, ok},
+		{"rel-inside", ok, escape, ok},
+		{filepath.Join("sub", "up", "a..b"), ok, escape, ok},
+		{"rel-escape", escape, escape, ok},
+		{"abs-escape", escape, escape, ok},
+		{filepath.Join("dir-escape", "secret"), escape, escape, ok},
+		{filepath.Join("..", "outside", "secret"), escape, escape, escape},
+		{filepath.Join("sub", "..", "..", "outside", "secret"), escape, escape, escape},
+		{filepath.Join("sub", "loop"), fail, escape, fail},
+		{"missing", fail, fail, fail},
+	}
+
+	check := func(t *testing.T, path string, want int, f *os.File, err error) {
+		t.Helper()
+		switch want {
+		case ok:
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", path, err)
+			}
+			f.Close()
+		case escape:
+			if !errors.Is(err, ErrOutsideRoot) {
+				t.Fatalf("%s: expected escape error, got %v", path, err)
+			}
+		case fail:
+			if err == nil || errors.Is(err, ErrOutsideRoot) {
+				t.Fatalf("%s: expected error, got %v", path, err)
+			}
+		}
+	}
+
+	policies := []struct {
+		name   string
+		policy SymlinkPolicy
+		want   func(i int) int
+	}{
+		{"beneath", SymlinksBeneath, func(i int) int { return cases[i].beneath }},
+		{"deny", SymlinksDeny, func(i int) int { return cases[i].deny }},
+		{"follow", SymlinksFollow, func(i int) int { return cases[i].follow }},
+	}
+
+	for _, p := range policies {
+		t.Run(p.name, func(t *testing.T) {
+			s := New(root, WithSymlinkPolicy(p.policy))
+			for i, c := range cases {
+				f, err := s.getFile(filepath.Join(root, c.path))
+				check(t, c.path, p.want(i), f, err)
+
+				// the userspace fallback behaves the same
+				if rel, inside := s.relPath(filepath.Join(root, c.path)); inside {
+					f, err := openBeneathUser(root, rel, p.policy)
+					check(t, c.path, p.want(i), f, err)
+				}
+			}
+		})
+	}
+
+	// reads through the source report escapes as corrupt references
+	s := New(root)
+	_, err := s.GetPart(bg, filepath.Join(root, "rel-escape"), 0, 1)
+	var cerr *rs.CorruptReferenceError
+	if !errors.As(err, &cerr) || cerr.Code != rs.StatusOtherError {
+		t.Fatalf("expected corrupt reference error, got %v", err)
+	}
+
+	r, _, err := s.Get(bg, filepath.Join(root, "a..b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "dots" {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	if _, err := s.Stat(bg, filepath.Join(outside, "secret")); !errors.Is(err, ErrOutsideRoot) {
+		t.Fatalf("expected escape error, got %v", err)
+	}
+}
@@ -4,34 +4,87 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	rs "github.com/Dreamacro/go-ds-remote"
+	"github.com/ipfs/boxo/blockservice"
 	blockstore "github.com/ipfs/boxo/blockstore"
+	chunk "github.com/ipfs/boxo/chunker"
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/boxo/exchange/offline"
+	pb "github.com/ipfs/boxo/filestore/pb"
 	posinfo "github.com/ipfs/boxo/filestore/posinfo"
 	dag "github.com/ipfs/boxo/ipld/merkledag"
+	mdtest "github.com/ipfs/boxo/ipld/merkledag/test"
+	"github.com/ipfs/boxo/ipld/unixfs"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
+	cidutil "github.com/ipfs/go-cidutil"
 	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
 	ipld "github.com/ipfs/go-ipld-format"
+	mh "github.com/multiformats/go-multihash"
+	proto "google.golang.org/protobuf/proto"
 )
 
 var bg = context.Background()
 
-func newTestFilestore(t *testing.T) (string, *rs.Remotestore) {
+func newTestFilestore(t *testing.T, opts ...Option) (string, *rs.Remotestore) {
 	mds := ds.NewMapDatastore()
 
 	testdir, err := os.MkdirTemp("", "filestore-test")
 	if err != nil {
 		t.Fatal(err)
 	}
-	fm := rs.NewRemoteManager(mds, New(testdir))
+	fm := rs.NewRemoteManager(mds, New(testdir, opts...))
 
 	bs := blockstore.NewBlockstore(mds)
 	fstore := rs.NewRemotestore(bs, fm)
 	return testdir, fstore
 }
 
+// testStore configures the Remotestore of newTestStore.
+type testStore struct {
+	// datastore is used instead of a new one when set.
+	datastore ds.Batching
+	// wrap wraps the Source of the directory when set.
+	wrap    func(*Source) rs.RemoteSource
+	manager []rs.ManagerOption
+	store   []rs.Option
+}
+
+// newTestStore is like newTestFilestore, with the options of the manager
+// and the store in c, over a directory removed with the test.
+func newTestStore(t *testing.T, c testStore) (string, *rs.Remotestore) {
+	mds := c.datastore
+	if mds == nil {
+		mds = ds.NewMapDatastore()
+	}
+
+	testdir := t.TempDir()
+	var source rs.RemoteSource = New(testdir)
+	if c.wrap != nil {
+		source = c.wrap(New(testdir))
+	}
+	fm := rs.NewRemoteManager(mds, source, c.manager...)
+
+	bs := blockstore.NewBlockstore(mds)
+	return testdir, rs.NewRemotestore(bs, fm, c.store...)
+}
+
 func makeFile(dir string, data []byte) (string, error) {
 	f, err := os.CreateTemp(dir, "file")
 	if err != nil {
@@ -165,3 +218,2109 @@ func TestDeletes(t *testing.T) {
 		}
 	}
 }
+
+func TestHandlePool(t *testing.T) {
+	dir, fs := newTestFilestore(t, WithHandlePool(1))
+	source := fs.RemoteManager().Source().(*Source)
+	defer source.Close()
+
+	fname, cids := randomFileAdd(t, fs, dir, 100)
+	for _, c := range cids {
+		if _, err := fs.RemoteManager().Get(bg, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := source.PoolStats()
+	if stats.Misses != 1 || stats.Hits != uint64(len(cids)-1) || stats.Open != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// a second file evicts the first one
+	_, others := randomFileAdd(t, fs, dir, 10)
+	if _, err := fs.RemoteManager().Get(bg, others[0]); err != nil {
+		t.Fatal(err)
+	}
+	if stats := source.PoolStats(); stats.Evictions != 1 || stats.Open != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// replacing the file invalidates its handle
+	if _, err := fs.RemoteManager().Get(bg, cids[0]); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	rand.Read(buf)
+	tmp, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.RemoteManager().Get(bg, cids[0])
+	var cerr *rs.CorruptReferenceError
+	if !errors.As(err, &cerr) || cerr.Code != rs.StatusFileChanged {
+		t.Fatalf("expected changed file error, got %v", err)
+	}
+	if stats := source.PoolStats(); stats.Invalidations != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHandlePoolConcurrent(t *testing.T) {
+	dir, fs := newTestFilestore(t, WithHandlePool(2))
+	defer fs.RemoteManager().Source().(*Source).Close()
+
+	var files [][]cid.Cid
+	for range 4 {
+		_, cids := randomFileAdd(t, fs, dir, 100)
+		files = append(files, cids)
+	}
+
+	var wg sync.WaitGroup
+	for _, cids := range files {
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, c := range cids {
+					if _, err := fs.RemoteManager().Get(bg, c); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestMmap(t *testing.T) {
+	dir, fs := newTestFilestore(t, WithMmap(150))
+	source := fs.RemoteManager().Source().(*Source)
+	defer source.Close()
+
+	fname, cids := randomFileAdd(t, fs, dir, 100)
+	for _, c := range cids {
+		if _, err := fs.RemoteManager().Get(bg, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := source.MmapStats()
+	if stats.Misses != 1 || stats.Hits != uint64(len(cids)-1) || stats.Open != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the limit only fits one mapping
+	_, others := randomFileAdd(t, fs, dir, 100)
+	if _, err := fs.RemoteManager().Get(bg, others[0]); err != nil {
+		t.Fatal(err)
+	}
+	if stats := source.MmapStats(); stats.Evictions != 1 || stats.Open != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// files larger than the limit are read normally, without evicting
+	// the mapping in the pool
+	_, large := randomFileAdd(t, fs, dir, 200)
+	if _, err := fs.RemoteManager().Get(bg, large[0]); err != nil {
+		t.Fatal(err)
+	}
+	if stats := source.MmapStats(); stats.Evictions != 1 || stats.Open != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if err := os.Truncate(fname, 50); err != nil {
+		t.Fatal(err)
+	}
+	_, err := fs.RemoteManager().Get(bg, cids[len(cids)-1])
+	var cerr *rs.CorruptReferenceError
+	if !errors.As(err, &cerr) || cerr.Code != rs.StatusFileChanged {
+		t.Fatalf("expected changed file error, got %v", err)
+	}
+}
+
+func TestMmapTruncatedWhileViewed(t *testing.T) {
+	dir, fs := newTestFilestore(t, WithMmap(1<<20))
+	source := fs.RemoteManager().Source().(*Source)
+	defer source.Close()
+
+	buf := make([]byte, 3*os.Getpagesize())
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = source.ViewPart(bg, fname, 0, uint64(len(buf)), func(data []byte) error {
+		if err := os.Truncate(fname, 0); err != nil {
+			t.Fatal(err)
+		}
+		_ = bytes.Equal(data, buf)
+		return nil
+	})
+	var cerr *rs.CorruptReferenceError
+	if !errors.As(err, &cerr) || cerr.Code != rs.StatusFileChanged {
+		t.Fatalf("expected changed file error, got %v", err)
+	}
+}
+
+func TestStatCheck(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	fm := rs.NewRemoteManager(mds, New(dir), rs.WithStatCheck())
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache())
+
+	buf := make([]byte, 1000)
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := fs.SyncIndex(bg, fname, rs.SyncIndexOptions{Chunker: "size-100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := node.Links()[0].Cid
+
+	info, err := fm.ObjectInfo(bg, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 1000 || info.ModTime.IsZero() || info.Inode == 0 {
+		t.Fatalf("unexpected object info %+v", info)
+	}
+
+	if _, err := fs.Get(bg, leaf); err != nil {
+		t.Fatal(err)
+	}
+	if res := rs.VerifyObject(bg, fs, leaf); res.Status != rs.StatusOk {
+		t.Fatalf("unexpected status %s", res.Status)
+	}
+
+	// touching the file is enough to flag it as changed
+	mtime := info.ModTime.Add(time.Hour)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Get(bg, leaf)
+	var cerr *rs.CorruptReferenceError
+	if !errors.As(err, &cerr) || cerr.Code != rs.StatusFileChanged {
+		t.Fatalf("expected changed file error, got %v", err)
+	}
+	if res := rs.VerifyObject(bg, fs, leaf); res.Status != rs.StatusFileChanged {
+		t.Fatalf("unexpected status %s", res.Status)
+	}
+
+	next, err := rs.VerifyAllObjects(bg, fs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for r := next(bg); r != nil; r = next(bg) {
+		if r.Status != rs.StatusOk {
+			t.Fatalf("unexpected status %s", r.Status)
+		}
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 references, got %d", n)
+	}
+
+	if err := os.Remove(fname); err != nil {
+		t.Fatal(err)
+	}
+	if res := rs.VerifyObject(bg, fs, leaf); res.Status != rs.StatusFileNotFound {
+		t.Fatalf("unexpected status %s", res.Status)
+	}
+}
+
+func TestRelativeKeys(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), rs.NewRemoteManager(mds, New(root)), rs.WithoutCache())
+	fname, cids := randomFileAdd(t, fs, root, 100)
+
+	res := rs.List(bg, fs, cids[0])
+	if res.FilePath != filepath.Base(fname) {
+		t.Fatalf("expected a key relative to the root, got %s", res.FilePath)
+	}
+
+	// move the root, the references still resolve
+	moved := filepath.Join(base, "moved")
+	if err := os.Rename(root, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = rs.NewRemotestore(blockstore.NewBlockstore(mds), rs.NewRemoteManager(mds, New(moved)), rs.WithoutCache())
+	for _, c := range cids {
+		if _, err := fs.Get(bg, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// keys starting with a slash are relative to the root as well
+	s := New(moved, WithRelativeKeys())
+	key, err := s.NormalizeKey("/" + filepath.Base(fname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != filepath.Base(fname) {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if _, err := s.NormalizeKey("/../" + filepath.Base(fname)); !errors.Is(err, ErrOutsideRoot) {
+		t.Fatalf("expected escape error, got %v", err)
+	}
+}
+
+// rawSource hides the key normalization of a source.
+type rawSource struct {
+	rs.RemoteSource
+}
+
+func TestNormalizeReferences(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	source := New(dir)
+
+	// references written before keys were relative
+	fm := rs.NewRemoteManager(mds, rawSource{source})
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache())
+	fname, cids := randomFileAdd(t, fs, dir, 100)
+	if err := fm.PutObjectInfo(bg, fname, &rs.ObjectInfo{Size: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if res := rs.List(bg, fs, cids[0]); res.FilePath != filepath.ToSlash(fname) {
+		t.Fatalf("expected an absolute key, got %s", res.FilePath)
+	}
+
+	// and an alternative location of the first block
+	blk, err := fs.Get(bg, cids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	alt, err := makeFile(dir, blk.RawData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put(bg, &posinfo.FilestoreNode{
+		PosInfo: &posinfo.PosInfo{FullPath: alt},
+		Node:    dag.NewRawNode(blk.RawData()),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	fm = rs.NewRemoteManager(mds, source)
+	fs = rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache())
+	n, err := fm.NormalizeReferences(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cids)+1 {
+		t.Fatalf("expected %d rewritten references, got %d", len(cids)+1, n)
+	}
+
+	locs, err := fm.Locations(bg, cids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 || locs[1].Key != filepath.Base(alt) {
+		t.Fatalf("unexpected locations %+v", locs)
+	}
+	if err := fm.RemoveLocation(bg, cids[0], filepath.Base(alt)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cids {
+		if res := rs.Verify(bg, fs, c); res.Status != rs.StatusOk || res.FilePath != filepath.Base(fname) {
+			t.Fatalf("unexpected reference %s %s", res.Status, res.FilePath)
+		}
+	}
+
+	info, err := rs.NewRemoteManager(mds, rawSource{source}).ObjectInfo(bg, filepath.Base(fname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 100 {
+		t.Fatalf("unexpected object info %+v", info)
+	}
+
+	n, err = fm.NormalizeReferences(bg)
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing to rewrite, got %d %v", n, err)
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	fm := rs.NewRemoteManager(mds, New(dir))
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache())
+
+	fname, cids := randomFileAdd(t, fs, dir, 100)
+	other, _ := randomFileAdd(t, fs, dir, 50)
+
+	refs, err := fm.ListByKey(bg, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != len(cids) {
+		t.Fatalf("expected %d references, got %d", len(cids), len(refs))
+	}
+	for i, ref := range refs {
+		if !ref.Cid.Equals(cids[i]) || ref.Offset != uint64(i*10) || ref.Size != 10 {
+			t.Fatalf("unexpected reference %d: %+v", i, ref)
+		}
+	}
+
+	if err := fs.DeleteBlock(bg, cids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ = fm.ListByKey(bg, fname); len(refs) != len(cids)-1 {
+		t.Fatalf("expected deleted block to leave the index, got %d references", len(refs))
+	}
+
+	renamed := filepath.Join(dir, "renamed")
+	if err := os.Rename(fname, renamed); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fm.RenameKey(bg, fname, renamed)
+	if err != nil || n != len(cids)-1 {
+		t.Fatalf("expected %d renamed references, got %d %v", len(cids)-1, n, err)
+	}
+	if refs, _ = fm.ListByKey(bg, fname); len(refs) != 0 {
+		t.Fatalf("expected no references to the old key, got %d", len(refs))
+	}
+	for _, c := range cids[1:] {
+		if res := rs.Verify(bg, fs, c); res.Status != rs.StatusOk || res.FilePath != "renamed" {
+			t.Fatalf("unexpected reference %s %s", res.Status, res.FilePath)
+		}
+	}
+
+	n, err = fm.RemoveByKey(bg, renamed)
+	if err != nil || n != len(cids)-1 {
+		t.Fatalf("expected %d removed references, got %d %v", len(cids)-1, n, err)
+	}
+	for _, c := range cids[1:] {
+		if has, _ := fs.Has(bg, c); has {
+			t.Fatal("shouldnt have reference to this key anymore")
+		}
+	}
+
+	// a rebuilt index matches the maintained one
+	before, err := fm.ListByKey(bg, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mds.Put(bg, rs.RemotestoreIndexPrefix.ChildString("stale"), nil); err != nil {
+		t.Fatal(err)
+	}
+	n, err = fm.RebuildKeyIndex(bg)
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 indexed references, got %d %v", n, err)
+	}
+	after, err := fm.ListByKey(bg, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 5 || len(after) != len(before) {
+		t.Fatalf("expected 5 references, got %d and %d", len(before), len(after))
+	}
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("unexpected rebuilt reference %+v", after[i])
+		}
+	}
+	if has, _ := mds.Has(bg, rs.RemotestoreIndexPrefix.ChildString("stale")); has {
+		t.Fatal("expected the stale entry to be dropped")
+	}
+}
+
+func TestAlternativeLocations(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	fm := rs.NewRemoteManager(mds, New(dir))
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache())
+
+	shared := make([]byte, 10)
+	rand.Read(shared)
+	other := make([]byte, 10)
+	rand.Read(other)
+
+	first, err := makeFile(dir, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := makeFile(dir, append(other, shared...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := dag.NewRawNode(shared)
+	put := func(path string, offset uint64) *posinfo.FilestoreNode {
+		return &posinfo.FilestoreNode{
+			PosInfo: &posinfo.PosInfo{FullPath: path, Offset: offset},
+			Node:    node,
+		}
+	}
+	if err := fs.Put(bg, put(first, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PutMany(bg, []blocks.Block{put(second, 10), put(second, 10)}); err != nil {
+		t.Fatal(err)
+	}
+
+	locs, err := fm.Locations(bg, node.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 || locs[0].Key != filepath.Base(first) || locs[1].Key != filepath.Base(second) || locs[1].Offset != 10 {
+		t.Fatalf("unexpected locations %+v", locs)
+	}
+
+	// the block is read from the second object once the first is gone
+	if err := os.Remove(first); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := fs.Get(bg, node.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blk.RawData(), shared) {
+		t.Fatal("data didnt match on the way out")
+	}
+
+	n, err := fm.RemoveByKey(bg, first)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 removed location, got %d %v", n, err)
+	}
+	if res := rs.Verify(bg, fs, node.Cid()); res.Status != rs.StatusOk || res.FilePath != filepath.Base(second) {
+		t.Fatalf("unexpected reference %s %s", res.Status, res.FilePath)
+	}
+
+	if err := fm.RemoveLocation(bg, node.Cid(), first); !ipld.IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if err := fm.RemoveLocation(bg, node.Cid(), second); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := fs.Has(bg, node.Cid()); has {
+		t.Fatal("shouldnt have reference to this block anymore")
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	dir := t.TempDir()
+	add := func(opts ...rs.Option) (blockstore.Blockstore, *rs.Remotestore, []cid.Cid) {
+		mds := ds.NewMapDatastore()
+		bs := blockstore.NewBlockstore(mds)
+		fs := rs.NewRemotestore(bs, rs.NewRemoteManager(mds, New(dir)), opts...)
+		_, cids := randomFileAdd(t, fs, dir, 100)
+		return bs, fs, cids
+	}
+	cached := func(bs blockstore.Blockstore, cids []cid.Cid) int {
+		n := 0
+		for _, c := range cids {
+			if has, _ := bs.Has(bg, c); has {
+				n++
+			}
+		}
+		return n
+	}
+	read := func(fs *rs.Remotestore, cids ...cid.Cid) {
+		for _, c := range cids {
+			if _, err := fs.Get(bg, c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	bs, fs, cids := add(rs.WithCachePolicy(rs.LRUCache(30)))
+	read(fs, cids...)
+	if n := cached(bs, cids); n != 3 {
+		t.Fatalf("expected 3 cached blocks, got %d", n)
+	}
+	if n := cached(bs, cids[len(cids)-3:]); n != 3 {
+		t.Fatal("expected the last read blocks to be cached")
+	}
+
+	bs, fs, cids = add(rs.WithCachePolicy(rs.ARCCache(30)))
+	read(fs, cids[0], cids[1], cids[0], cids[1])
+	read(fs, cids[2:]...)
+	if n := cached(bs, cids[:2]); n != 2 {
+		t.Fatal("expected the frequently read blocks to survive a scan")
+	}
+	if n := cached(bs, cids); n != 3 {
+		t.Fatalf("expected 3 cached blocks, got %d", n)
+	}
+
+	bs, fs, cids = add(rs.WithCachePolicy(rs.FrequentCache(2, rs.AlwaysCache())))
+	read(fs, cids[0], cids[0], cids[1])
+	if n := cached(bs, cids); n != 0 {
+		t.Fatalf("expected no cached block, got %d", n)
+	}
+	read(fs, cids[0])
+	if n := cached(bs, cids); n != 1 {
+		t.Fatalf("expected 1 cached block, got %d", n)
+	}
+
+	bs, fs, cids = add(rs.WithCachePolicy(rs.TTLCache(time.Millisecond)))
+	read(fs, cids[0])
+	if n := cached(bs, cids); n != 1 {
+		t.Fatalf("expected 1 cached block, got %d", n)
+	}
+	time.Sleep(5 * time.Millisecond)
+	read(fs, cids[1])
+	if has, _ := bs.Has(bg, cids[0]); has {
+		t.Fatal("expected the expired block to be evicted")
+	}
+
+	// a store created again accounts for the copies cached before
+	mds := ds.NewMapDatastore()
+	bs = blockstore.NewBlockstore(mds)
+	restart := func(p rs.CachePolicy) *rs.Remotestore {
+		return rs.NewRemotestore(bs, rs.NewRemoteManager(mds, New(dir)), rs.WithCachePolicy(p))
+	}
+	fs = restart(rs.LRUCache(30))
+	_, cids = randomFileAdd(t, fs, dir, 100)
+	read(fs, cids[:3]...)
+
+	fs = restart(rs.LRUCache(20))
+	if has, _ := bs.Has(bg, cids[0]); has || cached(bs, cids) != 2 {
+		t.Fatal("expected the oldest copy to be evicted past the limit")
+	}
+	read(fs, cids[3])
+	if n := cached(bs, cids); n != 2 {
+		t.Fatalf("expected the seeded copies to count toward the limit, got %d cached blocks", n)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	restart(rs.TTLCache(time.Millisecond))
+	if n := cached(bs, cids); n != 0 {
+		t.Fatalf("expected the expired copies to be evicted, got %d cached blocks", n)
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	bs := blockstore.NewBlockstore(mds)
+	fm := rs.NewRemoteManager(mds, New(dir))
+	fs := rs.NewRemotestore(bs, fm)
+
+	fname, cids := randomFileAdd(t, fs, dir, 100)
+	regular := dag.NodeWithData([]byte("regular"))
+	if err := fs.Put(bg, regular); err != nil {
+		t.Fatal(err)
+	}
+	readAll := func() {
+		for _, c := range cids {
+			if _, err := fs.Get(bg, c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	cached := func() []rs.CachedBlock {
+		blocks, err := fs.CachedBlocks(bg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blocks
+	}
+
+	readAll()
+	if n := len(cached()); n != len(cids) {
+		t.Fatalf("expected %d cached blocks, got %d", len(cids), n)
+	}
+
+	n, err := fs.EvictCache(bg, func(b rs.CachedBlock) bool {
+		return b.Cid.Equals(cids[0]) || b.Cid.Equals(cids[1])
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 evicted blocks, got %d %v", n, err)
+	}
+	if has, _ := bs.Has(bg, cids[0]); has {
+		t.Fatal("expected the evicted block to leave the main blockstore")
+	}
+
+	readAll()
+	n, err = fs.TrimCache(bg, 50)
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 evicted blocks, got %d %v", n, err)
+	}
+
+	readAll()
+	ctx, cancel := context.WithTimeout(bg, 50*time.Millisecond)
+	defer cancel()
+	if err := fs.RunCacheCleaner(ctx, 30, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if n := len(cached()); n != 3 {
+		t.Fatalf("expected 3 cached blocks, got %d", n)
+	}
+
+	// the copies of removed references are the only ones left
+	readAll()
+	if _, err := fm.RemoveByKey(bg, fname); err != nil {
+		t.Fatal(err)
+	}
+	n, err = fs.EvictCache(bg, nil)
+	if err != nil || n != 0 {
+		t.Fatalf("expected no evicted block, got %d %v", n, err)
+	}
+	if n := len(cached()); n != 0 {
+		t.Fatalf("expected no cached block, got %d", n)
+	}
+	readAll()
+	if has, _ := bs.Has(bg, regular.Cid()); !has {
+		t.Fatal("expected the regular block to be kept")
+	}
+
+	// a block put over a cached copy is a regular block
+	_, cids = randomFileAdd(t, fs, dir, 10)
+	readAll()
+	blk, err := bs.Get(bg, cids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put(bg, blk); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := fs.EvictCache(bg, nil); n != 0 || len(cached()) != 0 {
+		t.Fatal("expected the block put to be kept")
+	}
+}
+
+type viewerBlockstore struct {
+	blockstore.Blockstore
+	views int
+}
+
+func (bs *viewerBlockstore) View(ctx context.Context, c cid.Cid, fn func([]byte) error) error {
+	bs.views++
+	blk, err := bs.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	return fn(blk.RawData())
+}
+
+func TestView(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithMmap(1 << 20)}} {
+		mds := ds.NewMapDatastore()
+		dir := t.TempDir()
+		bs := &viewerBlockstore{Blockstore: blockstore.NewBlockstore(mds)}
+		fs := rs.NewRemotestore(bs, rs.NewRemoteManager(mds, New(dir, opts...)))
+		fname, cids := randomFileAdd(t, fs, dir, 100)
+
+		data, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, c := range cids {
+			err := fs.View(bg, c, func(b []byte) error {
+				if !bytes.Equal(b, data[i*10:(i+1)*10]) {
+					t.Fatal("data didnt match on the way out")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the cached copies are viewed from the main blockstore
+		views := bs.views
+		if err := fs.View(bg, cids[0], func([]byte) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if bs.views != views+1 {
+			t.Fatal("expected the main blockstore to be viewed")
+		}
+
+		errView := errors.New("view failed")
+		if _, err := fs.EvictCache(bg, nil); err != nil {
+			t.Fatal(err)
+		}
+		calls := 0
+		err = fs.View(bg, cids[0], func([]byte) error {
+			calls++
+			return errView
+		})
+		if err != errView || calls != 1 {
+			t.Fatalf("expected the error of fn, got %v after %d calls", err, calls)
+		}
+
+		missing := dag.NewRawNode([]byte("missing")).Cid()
+		if err := fs.View(bg, missing, func([]byte) error { return nil }); !ipld.IsNotFound(err) {
+			t.Fatalf("expected not found error, got %v", err)
+		}
+	}
+}
+
+func benchmarkRead(b *testing.B, view bool, opts ...Option) {
+	mds := ds.NewMapDatastore()
+	dir := b.TempDir()
+	fm := rs.NewRemoteManager(mds, New(dir, opts...))
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache())
+
+	buf := make([]byte, 256<<10)
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	n := &posinfo.FilestoreNode{
+		PosInfo: &posinfo.PosInfo{FullPath: fname},
+		Node:    dag.NewRawNode(buf),
+	}
+	if err := fs.Put(bg, n); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if view {
+			err = fs.View(bg, n.Cid(), func([]byte) error { return nil })
+		} else {
+			_, err = fs.Get(bg, n.Cid())
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B)      { benchmarkRead(b, false) }
+func BenchmarkView(b *testing.B)     { benchmarkRead(b, true) }
+func BenchmarkGetMmap(b *testing.B)  { benchmarkRead(b, false, WithMmap(1<<20)) }
+func BenchmarkViewMmap(b *testing.B) { benchmarkRead(b, true, WithMmap(1<<20)) }
+
+// countingSource counts the parts read from a source.
+type countingSource struct {
+	rs.RemoteSource
+	parts atomic.Int64
+}
+
+func (s *countingSource) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	s.parts.Add(1)
+	return s.RemoteSource.GetPart(ctx, key, offset, size)
+}
+
+func TestPrefetch(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	source := &countingSource{RemoteSource: New(dir)}
+	fm := rs.NewRemoteManager(mds, source)
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache(), rs.WithPrefetch(4, 1<<20))
+
+	buf := make([]byte, 10*1024)
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.SyncIndex(bg, fname, rs.SyncIndexOptions{Chunker: "size-1024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := root.Links()
+	if len(links) != 10 {
+		t.Fatalf("expected 10 leaves, got %d", len(links))
+	}
+
+	waitFetched := func(n uint64) {
+		t.Helper()
+		for i := 0; fs.PrefetchStats().Fetched < n; i++ {
+			if i == 1000 {
+				t.Fatalf("expected %d prefetched blocks, got %+v", n, fs.PrefetchStats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if _, err := fs.Get(bg, root.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	waitFetched(4)
+
+	var out []byte
+	for i, l := range links {
+		err := fs.View(bg, l.Cid, func(data []byte) error {
+			out = append(out, data...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFetched(uint64(min(len(links), i+5)))
+	}
+	if !bytes.Equal(out, buf) {
+		t.Fatal("data didnt match on the way out")
+	}
+
+	stats := fs.PrefetchStats()
+	if stats.Hits != uint64(len(links)) || stats.Dropped != 0 {
+		t.Fatalf("expected every leaf to be prefetched, got %+v", stats)
+	}
+	if parts := source.parts.Load(); parts >= int64(len(links)) || uint64(parts) != stats.Reads {
+		t.Fatalf("expected coalesced reads, got %d reads for %+v", parts, stats)
+	}
+}
+
+func TestPrefetchLimit(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	fm := rs.NewRemoteManager(mds, New(dir))
+	// the 8 next children don't fit in the buffer
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, rs.WithoutCache(), rs.WithPrefetch(8, 4096))
+
+	buf := make([]byte, 10*1024)
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.SyncIndex(bg, fname, rs.SyncIndexOptions{Chunker: "size-1024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Get(bg, root.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; fs.PrefetchStats().Fetched < 4; i++ {
+		if i == 1000 {
+			t.Fatalf("expected the children fitting in the buffer to be prefetched, got %+v", fs.PrefetchStats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i, l := range root.Links()[:4] {
+		if _, err := fs.Get(bg, l.Cid); err != nil {
+			t.Fatal(err)
+		}
+		if stats := fs.PrefetchStats(); stats.Hits != uint64(i+1) {
+			t.Fatalf("expected the child %d to be prefetched, got %+v", i, stats)
+		}
+	}
+
+	if stats := fs.PrefetchStats(); stats.Dropped != 0 {
+		t.Fatalf("expected no prefetched block to be dropped, got %+v", stats)
+	}
+	fs.Close()
+
+	// closing cancels the prefetches waiting for the source
+	gated := &gatedSource{countingSource: countingSource{RemoteSource: New(dir)}, gate: make(chan struct{})}
+	fs2 := rs.NewRemotestore(blockstore.NewBlockstore(mds), rs.NewRemoteManager(mds, gated), rs.WithoutCache(), rs.WithPrefetch(8, 4096))
+	if _, err := fs2.Get(bg, root.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		fs2.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didnt cancel the prefetches")
+	}
+	if stats := fs2.PrefetchStats(); stats.Fetched != 0 {
+		t.Fatalf("expected nothing prefetched, got %+v", stats)
+	}
+}
+
+// gatedSource blocks the parts read from a source until the gate is open.
+type gatedSource struct {
+	countingSource
+	gate chan struct{}
+}
+
+func (s *gatedSource) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	select {
+	case <-s.gate:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.countingSource.GetPart(ctx, key, offset, size)
+}
+
+func TestCoalescedGet(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	dir := t.TempDir()
+	source := &gatedSource{countingSource: countingSource{RemoteSource: New(dir)}, gate: make(chan struct{})}
+	fm := rs.NewRemoteManager(mds, source)
+	fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm)
+	_, cids := randomFileAdd(t, fs, dir, 20)
+
+	waitCoalesced := func(n uint64) {
+		t.Helper()
+		for i := 0; fs.FetchStats().Coalesced < n; i++ {
+			if i == 1000 {
+				t.Fatalf("expected %d coalesced requests, got %+v", n, fs.FetchStats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	const waiters = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fs.Get(bg, cids[0])
+			errs <- err
+		}()
+	}
+
+	// a waiter leaving does not cancel the fetch of the others
+	ctx, cancel := context.WithCancel(bg)
+	done := make(chan error)
+	go func() {
+		_, err := fs.Get(ctx, cids[0])
+		done <- err
+	}()
+	waitCoalesced(waiters)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+
+	close(source.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if parts := source.parts.Load(); parts != 1 {
+		t.Fatalf("expected a single read, got %d", parts)
+	}
+	if stats := fs.FetchStats(); stats.Fetches != 1 || stats.Coalesced != waiters {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the fetch is cancelled once all its waiters left
+	source.gate = make(chan struct{})
+	ctx, cancel = context.WithCancel(bg)
+	go func() {
+		_, err := fm.Get(ctx, cids[1])
+		done <- err
+	}()
+	for fm.FetchStats().Fetches == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+	close(source.gate)
+	if _, err := fm.Get(bg, cids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if stats := fm.FetchStats(); stats.Fetches != 2 || stats.Coalesced != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// countingDatastore counts the lookups of a datastore.
+type countingDatastore struct {
+	ds.Batching
+	lookups atomic.Int64
+}
+
+func (d *countingDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	d.lookups.Add(1)
+	return d.Batching.Get(ctx, key)
+}
+
+func (d *countingDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	d.lookups.Add(1)
+	return d.Batching.Has(ctx, key)
+}
+
+func (d *countingDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	d.lookups.Add(1)
+	return d.Batching.GetSize(ctx, key)
+}
+
+func TestLookupMisses(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []rs.Option
+	}{
+		{"bloom", []rs.Option{rs.WithBloomFilter(1000, 0.001)}},
+		{"negative", []rs.Option{rs.WithNegativeCache(100)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mds := &countingDatastore{Batching: ds.NewMapDatastore()}
+			dir := t.TempDir()
+			fm := rs.NewRemoteManager(mds, New(dir))
+			fs := rs.NewRemotestore(blockstore.NewBlockstore(mds), fm, tc.opts...)
+
+			_, cids := randomFileAdd(t, fs, dir, 100)
+			if err := fs.RebuildBloom(bg); err != nil {
+				t.Fatal(err)
+			}
+
+			missing := dag.NodeWithData([]byte("missing"))
+			if has, err := fs.Has(bg, missing.Cid()); err != nil || has {
+				t.Fatalf("expected a miss, got %v %v", has, err)
+			}
+
+			lookups := mds.lookups.Load()
+			if has, err := fs.Has(bg, missing.Cid()); err != nil || has {
+				t.Fatalf("expected a miss, got %v %v", has, err)
+			}
+			if _, err := fs.Get(bg, missing.Cid()); !ipld.IsNotFound(err) {
+				t.Fatalf("expected not found error, got %v", err)
+			}
+			if _, err := fs.GetSize(bg, missing.Cid()); !ipld.IsNotFound(err) {
+				t.Fatalf("expected not found error, got %v", err)
+			}
+			if n := mds.lookups.Load() - lookups; n != 0 {
+				t.Fatalf("expected misses without lookups, got %d", n)
+			}
+
+			for _, c := range cids {
+				if has, err := fs.Has(bg, c); err != nil || !has {
+					t.Fatalf("expected a hit, got %v %v", has, err)
+				}
+			}
+
+			if err := fs.Put(bg, missing); err != nil {
+				t.Fatal(err)
+			}
+			if has, err := fs.Has(bg, missing.Cid()); err != nil || !has {
+				t.Fatalf("expected the put block, got %v %v", has, err)
+			}
+
+			if err := fs.DeleteBlock(bg, cids[0]); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.RebuildBloom(bg); err != nil {
+				t.Fatal(err)
+			}
+			if has, err := fs.Has(bg, cids[0]); err != nil || has {
+				t.Fatalf("expected the deleted block to be missing, got %v %v", has, err)
+			}
+
+			// blocks written by the manager without going through fs
+			data := []byte("written by the manager")
+			fname, err := makeFile(dir, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			direct := &posinfo.FilestoreNode{PosInfo: &posinfo.PosInfo{FullPath: fname}, Node: dag.NewRawNode(data)}
+			if has, err := fs.Has(bg, direct.Cid()); err != nil || has {
+				t.Fatalf("expected a miss, got %v %v", has, err)
+			}
+			if err := fm.Put(bg, direct); err != nil {
+				t.Fatal(err)
+			}
+			if has, err := fs.Has(bg, direct.Cid()); err != nil || !has {
+				t.Fatalf("expected the block put in the manager, got %v %v", has, err)
+			}
+
+			if err := fs.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRawLeafPolicy(t *testing.T) {
+	raw := func(data string) blocks.Block {
+		return dag.NewRawNode([]byte(data))
+	}
+	expectRejected := func(err error, policy rs.RawLeafPolicy) {
+		t.Helper()
+		var rerr *rs.RawLeafError
+		if !errors.As(err, &rerr) || rerr.Policy != policy {
+			t.Fatalf("expected a raw leaf error, got %v", err)
+		}
+	}
+
+	// Put and PutMany both store raw blocks by default
+	_, fs := newTestFilestore(t)
+	bs := fs.MainBlockstore()
+	if err := fs.Put(bg, raw("put")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PutMany(bg, []blocks.Block{raw("put many")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []blocks.Block{raw("put"), raw("put many")} {
+		if has, _ := bs.Has(bg, b.Cid()); !has {
+			t.Fatal("expected the raw block to be stored")
+		}
+	}
+
+	_, fs = newTestStore(t, testStore{store: []rs.Option{rs.WithRawLeafPolicy(rs.RawLeafReject)}})
+	bs = fs.MainBlockstore()
+	expectRejected(fs.Put(bg, raw("put")), rs.RawLeafReject)
+	regular := dag.NodeWithData([]byte("regular"))
+	expectRejected(fs.PutMany(bg, []blocks.Block{regular, raw("put many")}), rs.RawLeafReject)
+	if has, _ := bs.Has(bg, regular.Cid()); has {
+		t.Fatal("expected the rejected batch not to be written")
+	}
+
+	dir, fs := newTestStore(t, testStore{store: []rs.Option{rs.WithRawLeafPolicy(rs.RawLeafVerify)}})
+	bs = fs.MainBlockstore()
+	fname, cids := randomFileAdd(t, fs, dir, 20)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referenced := dag.NewRawNode(data[:10])
+	if !referenced.Cid().Equals(cids[0]) {
+		t.Fatal("expected the raw block to match the reference")
+	}
+	if err := fs.PutMany(bg, []blocks.Block{referenced}); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(bg, referenced.Cid()); has {
+		t.Fatal("expected the referenced block to be served by its reference")
+	}
+
+	expectRejected(fs.Put(bg, raw("unknown")), rs.RawLeafVerify)
+	forged, err := blocks.NewBlockWithCid(data[10:20], cids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRejected(fs.Put(bg, forged), rs.RawLeafVerify)
+}
+
+func TestNamespaces(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	var sourceA, sourceB *countingSource
+	dirA, fsA := newTestStore(t, testStore{
+		datastore: mds,
+		wrap: func(s *Source) rs.RemoteSource {
+			sourceA = &countingSource{RemoteSource: s}
+			return sourceA
+		},
+		manager: []rs.ManagerOption{rs.WithNamespace("a")},
+		store:   []rs.Option{rs.WithoutCache()},
+	})
+	// any name is a valid namespace
+	dirB, fsB := newTestStore(t, testStore{
+		datastore: mds,
+		wrap: func(s *Source) rs.RemoteSource {
+			sourceB = &countingSource{RemoteSource: s}
+			return sourceB
+		},
+		manager: []rs.ManagerOption{rs.WithNamespace("b/c")},
+		store:   []rs.Option{rs.WithoutCache()},
+	})
+	fmA, fmB := fsA.RemoteManager(), fsB.RemoteManager()
+
+	fnameA, cidsA := randomFileAdd(t, fsA, dirA, 50)
+	_, cidsB := randomFileAdd(t, fsB, dirB, 50)
+
+	// the managers share nothing
+	if has, _ := fmB.Has(bg, cidsA[0]); has {
+		t.Fatal("expected namespace b not to reference the blocks of a")
+	}
+	if refs, _ := fmB.ListByKey(bg, fnameA); len(refs) != 0 {
+		t.Fatalf("expected no references to the keys of a, got %d", len(refs))
+	}
+	if has, _ := mds.Has(bg, rs.RemotestorePrefix.Child(ds.NewKey(cidsA[0].Hash().B58String()))); has {
+		t.Fatal("expected no reference in the default namespace")
+	}
+
+	names, err := rs.Namespaces(bg, mds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b/c" {
+		t.Fatalf("unexpected namespaces %q", names)
+	}
+
+	// the default namespace keeps the layout of existing datastores
+	dir, fs := newTestStore(t, testStore{
+		datastore: mds,
+		manager:   []rs.ManagerOption{rs.WithNamespace("")},
+		store:     []rs.Option{rs.WithoutCache(), rs.WithManager(fmA, 1), rs.WithManager(fmB, -1)},
+	})
+	fm := fs.RemoteManager()
+	_, cids := randomFileAdd(t, fs, dir, 50)
+	if fm.Namespace() != "" || fmA.Namespace() != "a" {
+		t.Fatalf("unexpected namespaces %q and %q", fm.Namespace(), fmA.Namespace())
+	}
+	if names, _ = rs.Namespaces(bg, mds); len(names) != 3 || names[0] != "" {
+		t.Fatalf("unexpected namespaces %q", names)
+	}
+
+	managers := fs.Managers()
+	if len(managers) != 3 || managers[0] != fmA || managers[1] != fm || managers[2] != fmB {
+		t.Fatal("expected managers ordered by priority")
+	}
+
+	// the Remotestore serves the blocks of every manager
+	for _, c := range append(append(cids, cidsA...), cidsB...) {
+		if _, err := fs.Get(bg, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// blocks referenced by several managers are read from the first one
+	data, err := os.ReadFile(fnameA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := filepath.Join(dirB, filepath.Base(fnameA))
+	if err := os.WriteFile(copied, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fmB.Put(bg, &posinfo.FilestoreNode{
+		PosInfo: &posinfo.PosInfo{FullPath: copied},
+		Node:    dag.NewRawNode(data[:10]),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := sourceA.parts.Load(), sourceB.parts.Load()
+	if _, err := fs.Get(bg, cidsA[0]); err != nil {
+		t.Fatal(err)
+	}
+	if sourceA.parts.Load() != a+1 || sourceB.parts.Load() != b {
+		t.Fatal("expected the block to be read from namespace a")
+	}
+
+	// and from the next ones when it fails
+	if err := os.Remove(fnameA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(bg, cidsA[0]); err != nil {
+		t.Fatal(err)
+	}
+	if sourceB.parts.Load() != b+1 {
+		t.Fatal("expected the block to be read from namespace b")
+	}
+	if _, err := fs.Get(bg, cidsA[1]); err == nil {
+		t.Fatal("expected an error reading a block of a missing object")
+	}
+
+	// deleting a block removes it from every manager
+	if err := fs.DeleteBlock(bg, cidsA[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range managers {
+		if has, _ := m.Has(bg, cidsA[0]); has {
+			t.Fatalf("expected namespace %q not to reference the deleted block", m.Namespace())
+		}
+	}
+	if _, err := fs.Get(bg, cidsA[0]); !ipld.IsNotFound(err) {
+		t.Fatalf("expected not found reading a deleted block, got %v", err)
+	}
+
+	// a namespace without references is no longer listed
+	for _, c := range cidsB {
+		if err := fmB.DeleteBlock(bg, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names, _ = rs.Namespaces(bg, mds); len(names) != 2 || names[0] != "" || names[1] != "a" {
+		t.Fatalf("unexpected namespaces %q", names)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir, fs := newTestStore(t, testStore{store: []rs.Option{rs.WithoutCache()}})
+	fm := fs.RemoteManager()
+
+	buf := make([]byte, 4*1024)
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough leaves for intermediate nodes
+	root, err := fs.SyncIndex(bg, fname, rs.SyncIndexOptions{Chunker: "size-16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fm.ObjectInfo(bg, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Root.Equals(root.Cid()) {
+		t.Fatalf("expected root %s to be recorded, got %s", root.Cid(), info.Root)
+	}
+
+	// a second copy of the first leaf is an alternative location
+	copied, err := makeFile(dir, buf[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.Put(bg, &posinfo.FilestoreNode{
+		PosInfo: &posinfo.PosInfo{FullPath: copied},
+		Node:    dag.NewRawNode(buf[:16]),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest bytes.Buffer
+	n, err := fs.ExportManifest(bg, &manifest)
+	if err != nil || n != 257 {
+		t.Fatalf("expected 257 exported references, got %d %v", n, err)
+	}
+	// the root and its two children
+	if nodes := bytes.Count(manifest.Bytes(), []byte(`{"block":`)); nodes != 3 {
+		t.Fatalf("expected 3 exported nodes, got %d", nodes)
+	}
+
+	// import the manifest into a node serving the objects from elsewhere,
+	// checking their fingerprint before reading them
+	moved, fs2 := newTestStore(t, testStore{
+		manager: []rs.ManagerOption{rs.WithStatCheck()},
+		store:   []rs.Option{rs.WithoutCache()},
+	})
+	fm2 := fs2.RemoteManager()
+	if err := os.Mkdir(filepath.Join(moved, "moved"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{fname, copied} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(moved, "moved", filepath.Base(name))
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// the copies are newer than the exported objects
+		mtime := time.Now().Add(time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err = fs2.ImportManifest(bg, bytes.NewReader(manifest.Bytes()), rs.ImportOptions{
+		Rewrite: func(key string) string { return "moved/" + key },
+	})
+	if err != nil || n != 257 {
+		t.Fatalf("expected 257 imported references, got %d %v", n, err)
+	}
+
+	// the whole file is served from the imported root
+	dserv := dag.NewDAGService(blockservice.New(fs2, offline.Exchange(fs2)))
+	nd, err := dserv.Get(bg, root.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr, err := uio.NewDagReader(bg, nd, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, buf) {
+		t.Fatal("data didnt match on the way out")
+	}
+	next, err := rs.VerifyAllObjects(bg, fs2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r := next(bg); r != nil; r = next(bg) {
+		if r.Status != rs.StatusOk {
+			t.Fatalf("unexpected status %s of %s", r.Status, r.FilePath)
+		}
+	}
+
+	locs, err := fm2.Locations(bg, dag.NewRawNode(buf[:16]).Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 || locs[0].Key != "moved/"+filepath.Base(fname) {
+		t.Fatalf("unexpected locations %+v", locs)
+	}
+	info, err = fm2.ObjectInfo(bg, filepath.Join("moved", filepath.Base(fname)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Root.Equals(root.Cid()) {
+		t.Fatalf("expected root %s to be imported, got %s", root.Cid(), info.Root)
+	}
+
+	// skipped keys
+	_, fs3 := newTestFilestore(t)
+	n, err = fs3.ImportManifest(bg, bytes.NewReader(manifest.Bytes()), rs.ImportOptions{
+		Rewrite: func(key string) string {
+			if key == filepath.Base(copied) {
+				return ""
+			}
+			return "moved/" + key
+		},
+	})
+	if err != nil || n != 256 {
+		t.Fatalf("expected 256 imported references, got %d %v", n, err)
+	}
+
+	// invalid manifests
+	for _, bad := range []string{
+		`{"version":2}`,
+		"{\"version\":1}\n{\"ref\":{\"hash\":\"nope\",\"path\":\"a\",\"size\":1}}",
+		"{\"version\":1}\n{\"ref\":{\"hash\":\"" + root.Cid().Hash().B58String() + "\",\"path\":\"a\"}}",
+		"{\"version\":1}\n{}",
+		"{\"version\":1}\n{\"block\":{\"cid\":\"" + root.Cid().String() + "\",\"data\":\"AA==\"}}",
+	} {
+		_, fs := newTestFilestore(t)
+		_, err := fs.ImportManifest(bg, bytes.NewReader([]byte(bad)), rs.ImportOptions{})
+		if err == nil {
+			t.Fatalf("expected an error importing %s", bad)
+		}
+	}
+	// an object is only written along with the references of its batch
+	var object string
+	for _, line := range strings.Split(manifest.String(), "\n") {
+		if strings.HasPrefix(line, `{"object":`) {
+			object = line
+		}
+	}
+	_, fs4 := newTestFilestore(t)
+	if _, err := fs4.ImportManifest(bg, strings.NewReader("{\"version\":1}\n"+object+"\n{}"), rs.ImportOptions{}); err == nil {
+		t.Fatal("expected an error importing an invalid line")
+	}
+	if _, err := fs4.RemoteManager().ObjectInfo(bg, filepath.Base(fname)); err != ds.ErrNotFound {
+		t.Fatalf("expected the object of the failed batch not to be written, got %v", err)
+	}
+	if _, err := fs2.ImportManifest(bg, bytes.NewReader([]byte(`{"version":2}`)), rs.ImportOptions{}); !errors.Is(err, rs.ErrManifestVersion) {
+		t.Fatalf("expected ErrManifestVersion, got %v", err)
+	}
+}
+
+// queryHookDatastore calls hook once the entries of the next query are
+// read, before returning them.
+type queryHookDatastore struct {
+	ds.Batching
+	hook func()
+}
+
+func (d *queryHookDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	hook := d.hook
+	if hook == nil {
+		return d.Batching.Query(ctx, q)
+	}
+	d.hook = nil
+
+	qr, err := d.Batching.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := qr.Rest()
+	if err != nil {
+		return nil, err
+	}
+	hook()
+	return dsq.ResultsWithEntries(q, entries), nil
+}
+
+func TestRecords(t *testing.T) {
+	mds := &queryHookDatastore{Batching: ds.NewMapDatastore()}
+	dir, fs := newTestStore(t, testStore{
+		datastore: mds,
+		manager:   []rs.ManagerOption{rs.WithSourceID("disk")},
+		store:     []rs.Option{rs.WithoutCache()},
+	})
+	fm := fs.RemoteManager()
+
+	buf := make([]byte, 2*1024)
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := fs.SyncIndex(bg, fname, rs.SyncIndexOptions{Chunker: "size-1024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := fm.Record(bg, root.Links()[1].Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Version != rs.RecordVersion || rec.Path != filepath.Base(fname) || rec.Offset != 1024 || rec.Size != 1024 {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if !rec.ModTime.Equal(st.ModTime()) || rec.SourceID != "disk" || rec.Created.IsZero() || rec.Updated.IsZero() {
+		t.Fatalf("unexpected record metadata %+v", rec)
+	}
+
+	// records written before they were versioned
+	legacy, err := makeFile(dir, buf[:50])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.PutObjectInfo(bg, legacy, &rs.ObjectInfo{Size: 50, ETag: "etag", VersionID: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	putLegacy := func(path string, data []byte, offset int) cid.Cid {
+		t.Helper()
+		nd := dag.NewRawNode(data[offset : offset+10])
+		path, off, size := filepath.Base(path), uint64(offset), uint64(10)
+		rec, err := proto.Marshal(&pb.DataObj{FilePath: &path, Offset: &off, Size: &size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mds.Put(bg, rs.RemotestorePrefix.Child(dshelp.MultihashToDsKey(nd.Cid().Hash())), rec); err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid()
+	}
+	var cids []cid.Cid
+	for i := 0; i < 5; i++ {
+		cids = append(cids, putLegacy(legacy, buf, i*10))
+	}
+
+	rec, err = fm.Record(bg, cids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Version != 0 || rec.Offset != 20 || rec.Size != 10 || !rec.Updated.IsZero() {
+		t.Fatalf("unexpected legacy record %+v", rec)
+	}
+	if _, err := fs.Get(bg, cids[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// an interrupted migration resumes where it stopped
+	ctx, cancel := context.WithCancel(bg)
+	var progress []rs.MigrationProgress
+	n, err := fm.MigrateRecords(ctx, rs.MigrateOptions{
+		BatchSize: 2,
+		Progress: func(p rs.MigrationProgress) {
+			progress = append(progress, p)
+			cancel()
+		},
+	})
+	if !errors.Is(err, context.Canceled) || n != 2 || len(progress) != 1 || progress[0].Migrated != 2 {
+		t.Fatalf("expected the migration to stop after a batch, got %d %v %+v", n, err, progress)
+	}
+
+	n, err = fm.MigrateRecords(bg, rs.MigrateOptions{BatchSize: 2})
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 migrated records, got %d %v", n, err)
+	}
+	for _, c := range cids {
+		rec, err := fm.Record(bg, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Version != rs.RecordVersion || rec.ETag != "etag" || rec.VersionID != "v1" || rec.SourceID != "disk" || rec.Updated.IsZero() {
+			t.Fatalf("unexpected migrated record %+v", rec)
+		}
+		if _, err := fs.Get(bg, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err = fm.MigrateRecords(bg, rs.MigrateOptions{}); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to migrate, got %d %v", n, err)
+	}
+
+	// the records deleted or rewritten while being migrated stay so
+	other := make([]byte, 20)
+	rand.Read(other)
+	racing, err := makeFile(dir, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, promoted := putLegacy(racing, other, 0), putLegacy(racing, other, 10)
+	alt, err := makeFile(dir, other[10:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fm.Put(bg, &posinfo.FilestoreNode{
+		PosInfo: &posinfo.PosInfo{FullPath: alt},
+		Node:    dag.NewRawNode(other[10:]),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	mds.hook = func() {
+		if err := fm.DeleteBlock(bg, deleted); err != nil {
+			t.Fatal(err)
+		}
+		if err := fm.RemoveLocation(bg, promoted, racing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err = fm.MigrateRecords(bg, rs.MigrateOptions{}); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to migrate, got %d %v", n, err)
+	}
+	if mds.hook != nil {
+		t.Fatal("expected the records to change during the migration")
+	}
+	if has, _ := fm.Has(bg, deleted); has {
+		t.Fatal("expected the deleted record not to be brought back")
+	}
+	if rec, err := fm.Record(bg, promoted); err != nil || rec.Path != filepath.Base(alt) {
+		t.Fatalf("expected the promoted location to stay the reference, got %+v %v", rec, err)
+	}
+}
+
+// failingSource calls fail with the key once limit bytes of an object were
+// read, and fails the read if it returns an error.
+type failingSource struct {
+	*Source
+	limit int
+	fail  func(key string) error
+}
+
+func (s *failingSource) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
+	rc, size, err := s.Source.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	fail := func() error { return s.fail(key) }
+	return &failingReader{ReadCloser: rc, left: s.limit, fail: fail}, size, nil
+}
+
+type failingReader struct {
+	io.ReadCloser
+	left int
+	fail func() error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		if err := r.fail(); err != nil {
+			return 0, err
+		}
+		return r.ReadCloser.Read(p)
+	}
+	n, err := r.ReadCloser.Read(p[:min(len(p), r.left)])
+	r.left -= n
+	return n, err
+}
+
+func TestSyncRollback(t *testing.T) {
+	mds := ds.NewMapDatastore()
+	fail := func(string) error { return nil }
+	dir, fs := newTestStore(t, testStore{
+		datastore: mds,
+		wrap: func(s *Source) rs.RemoteSource {
+			return &failingSource{Source: s, limit: 5 * 1024, fail: func(key string) error { return fail(key) }}
+		},
+		store: []rs.Option{rs.WithoutCache()},
+	})
+	opts := rs.SyncIndexOptions{Chunker: "size-1024", Maxlinks: 2}
+
+	buf := make([]byte, 8*1024)
+	rand.Read(buf)
+	shared, err := makeFile(dir, buf[:2*1024])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.SyncIndex(bg, shared, opts); err != nil {
+		t.Fatal(err)
+	}
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func() []string {
+		t.Helper()
+		res, err := mds.Query(bg, dsq.Query{KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]string, len(entries))
+		for i, e := range entries {
+			out[i] = e.Key
+		}
+		return out
+	}
+	before := keys()
+
+	// a failed read leaves the store as it was
+	errNetwork := errors.New("network error")
+	fail = func(string) error { return errNetwork }
+	if _, err := fs.SyncIndex(bg, fname, opts); !errors.Is(err, errNetwork) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	if after := keys(); !slices.Equal(before, after) {
+		t.Fatalf("expected the failed sync to be rolled back, got %d keys instead of %d", len(after), len(before))
+	}
+
+	// and so does a cancelled sync
+	ctx, cancel := context.WithCancel(bg)
+	fail = func(string) error { cancel(); return nil }
+	if _, err := fs.SyncIndex(ctx, fname, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the sync to be cancelled, got %v", err)
+	}
+	if after := keys(); !slices.Equal(before, after) {
+		t.Fatalf("expected the cancelled sync to be rolled back, got %d keys instead of %d", len(after), len(before))
+	}
+
+	// the blocks shared with the other object are still there
+	fail = func(string) error { return nil }
+	root, err := fs.SyncIndex(bg, shared, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range root.Links() {
+		if _, err := fs.Get(bg, l.Cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := fs.SyncIndex(bg, fname, opts); err != nil {
+		t.Fatal(err)
+	}
+	// the blocks of the other object are not written again
+	if refs, err := fs.RemoteManager().ListByKey(bg, fname); err != nil || len(refs) != 6 {
+		t.Fatalf("expected 6 references, got %d %v", len(refs), err)
+	}
+}
+
+func TestSyncRollbackConcurrent(t *testing.T) {
+	buf := make([]byte, 8*1024)
+	rand.Read(buf)
+
+	// the sync of failed stops once it read everything, until resumed
+	var (
+		failed  string
+		once    sync.Once
+		reached = make(chan struct{})
+		resume  = make(chan struct{})
+	)
+	errNetwork := errors.New("network error")
+	dir, fs := newTestStore(t, testStore{
+		wrap: func(s *Source) rs.RemoteSource {
+			return &failingSource{Source: s, limit: len(buf), fail: func(key string) error {
+				if key != filepath.Base(failed) {
+					return nil
+				}
+				once.Do(func() { close(reached) })
+				<-resume
+				return errNetwork
+			}}
+		},
+		store: []rs.Option{rs.WithoutCache()},
+	})
+	opts := rs.SyncIndexOptions{Chunker: "size-1024", Maxlinks: 2}
+
+	failed, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := fs.SyncIndex(bg, failed, opts)
+		errc <- err
+	}()
+	<-reached
+
+	// the other sync finds the blocks written by the failing one
+	root, err := fs.SyncIndex(bg, synced, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(resume)
+	if err := <-errc; !errors.Is(err, errNetwork) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+
+	// and its DAG survives the rollback
+	dserv := dag.NewDAGService(blockservice.New(fs, offline.Exchange(fs)))
+	dr, err := uio.NewDagReader(bg, root, dserv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, buf) {
+		t.Fatal("expected the synced object to be read back")
+	}
+}
+
+func TestSyncCidOptions(t *testing.T) {
+	dir, fs := newTestStore(t, testStore{store: []rs.Option{rs.WithoutCache()}})
+
+	buf := make([]byte, 10*1024)
+	rand.Read(buf)
+	fname, err := makeFile(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := makeFile(dir, buf[:100])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// importDag builds the DAG of data with the importer of boxo
+	importDag := func(data []byte, builder cid.Builder, rawLeaves bool) ipld.Node {
+		t.Helper()
+		params := helpers.DagBuilderParams{
+			Dagserv:    mdtest.Mock(),
+			Maxlinks:   helpers.DefaultLinksPerBlock,
+			CidBuilder: builder,
+			RawLeaves:  rawLeaves,
+		}
+		db, err := params.New(chunk.NewSizeSplitter(bytes.NewReader(data), 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := balanced.Layout(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd
+	}
+	syncFile := func(key string, opts rs.SyncIndexOptions) ipld.Node {
+		t.Helper()
+		opts.Chunker = "size-1024"
+		nd, err := fs.SyncIndex(bg, key, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range append([]*ipld.Link{{Cid: nd.Cid()}}, nd.Links()...) {
+			if _, err := fs.Get(bg, l.Cid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nd
+	}
+
+	v1, err := dag.PrefixForCidVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blake3 := v1
+	blake3.MhType = mh.BLAKE3
+	blake3.MhLength = -1
+
+	for _, tc := range []struct {
+		name    string
+		opts    rs.SyncIndexOptions
+		builder cid.Builder
+	}{
+		{"default", rs.SyncIndexOptions{}, dag.V0CidPrefix()},
+		{"cidv1", rs.SyncIndexOptions{CidVersion: 1}, &v1},
+		{"blake3", rs.SyncIndexOptions{CidVersion: 1, HashFunction: "blake3"}, &blake3},
+		{"implied cidv1", rs.SyncIndexOptions{HashFunction: "blake3"}, &blake3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nd := syncFile(fname, tc.opts)
+			if expected := importDag(buf, tc.builder, true); !nd.Cid().Equals(expected.Cid()) {
+				t.Fatalf("expected root %s, got %s", expected.Cid(), nd.Cid())
+			}
+		})
+	}
+
+	// a single block is the raw root, or wrapped in a file node
+	if nd := syncFile(small, rs.SyncIndexOptions{CidVersion: 1}); nd.Cid().Type() != cid.Raw || !nd.Cid().Equals(importDag(buf[:100], &v1, true).Cid()) {
+		t.Fatalf("expected a raw root, got %s", nd.Cid())
+	}
+	nd := syncFile(small, rs.SyncIndexOptions{WrapSingleBlock: true})
+	if expected := importDag(buf[:100], dag.V0CidPrefix(), false); !nd.Cid().Equals(expected.Cid()) {
+		t.Fatalf("expected root %s, got %s", expected.Cid(), nd.Cid())
+	}
+	if nd := syncFile(fname, rs.SyncIndexOptions{WrapSingleBlock: true}); !nd.Cid().Equals(importDag(buf, dag.V0CidPrefix(), true).Cid()) {
+		t.Fatalf("expected several blocks to keep raw leaves, got %s", nd.Cid())
+	}
+
+	// small blocks are inlined like with the builder of `ipfs add --inline`
+	inlined, err := makeFile(dir, buf[:1024+16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd = syncFile(inlined, rs.SyncIndexOptions{CidVersion: 1, InlineLimit: 32})
+	if expected := importDag(buf[:1024+16], cidutil.InlineBuilder{Builder: &v1, Limit: 32}, true); !nd.Cid().Equals(expected.Cid()) {
+		t.Fatalf("expected root %s, got %s", expected.Cid(), nd.Cid())
+	}
+	leaves := nd.Links()
+	if len(leaves) != 2 || leaves[0].Cid.Prefix().MhType != mh.SHA2_256 {
+		t.Fatalf("unexpected leaves %v", leaves)
+	}
+	expected, err := cid.V1Builder{Codec: cid.Raw, MhType: mh.IDENTITY}.Sum(buf[1024 : 1024+16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaves[1].Cid.Equals(expected) {
+		t.Fatalf("expected inlined leaf %s, got %s", expected, leaves[1].Cid)
+	}
+	// the inlined leaf has no reference, even when put, its data is in its
+	// CID
+	leaf, err := dag.NewRawNodeWPrefix(buf[1024:1024+16], expected.Prefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put(bg, &posinfo.FilestoreNode{
+		Node:    leaf,
+		PosInfo: &posinfo.PosInfo{FullPath: inlined, Offset: 1024},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := fs.RemoteManager().Has(bg, leaf.Cid()); err != nil || has {
+		t.Fatalf("expected no reference of the inlined leaf, got %v %v", has, err)
+	}
+
+	if _, err := fs.SyncIndex(bg, fname, rs.SyncIndexOptions{HashFunction: "nope"}); err == nil {
+		t.Fatal("expected an error with an unknown hash function")
+	}
+}
+
+func TestSyncPrefix(t *testing.T) {
+	dir, fs := newTestStore(t, testStore{store: []rs.Option{rs.WithoutCache()}})
+	dserv := dag.NewDAGService(blockservice.New(fs, offline.Exchange(fs)))
+
+	contents := make(map[string][]byte)
+	for _, key := range []string{"photos/a.jpg", "photos/2024/b.jpg", "photos/2024/c.jpg", "photos2/d.jpg", "other/e.jpg"} {
+		buf := make([]byte, 3000)
+		rand.Read(buf)
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(key)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, key), buf, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		contents[key] = buf
+	}
+
+	// read returns the content of the file at path in the directory root
+	read := func(root ipld.Node, path string) []byte {
+		t.Helper()
+		nd := root
+		for _, name := range strings.Split(path, "/") {
+			d, err := uio.NewDirectoryFromNode(dserv, nd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nd, err = d.Find(bg, name); err != nil {
+				t.Fatalf("finding %s: %s", path, err)
+			}
+		}
+		r, err := uio.NewDagReader(bg, nd, dserv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	root, entries, err := fs.SyncPrefix(bg, "photos/", rs.SyncIndexOptions{Chunker: "size-1024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Err != nil {
+			t.Fatal(e.Err)
+		}
+		if e.Key != "photos/"+e.Path {
+			t.Fatalf("unexpected entry %s at %s", e.Key, e.Path)
+		}
+		if !bytes.Equal(read(root, e.Path), contents[e.Key]) {
+			t.Fatalf("unexpected content of %s", e.Path)
+		}
+	}
+	if links := root.Links(); len(links) != 2 || links[0].Name != "2024" || links[1].Name != "a.jpg" {
+		t.Fatalf("unexpected root links %v", links)
+	}
+
+	// an absolute prefix lists the same keys, relative to the root
+	abs, entries, err := fs.SyncPrefix(bg, filepath.Join(dir, "photos")+"/", rs.SyncIndexOptions{Chunker: "size-1024"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || !abs.Cid().Equals(root.Cid()) {
+		t.Fatalf("expected the directory %s of 3 entries, got %s of %d", root.Cid(), abs.Cid(), len(entries))
+	}
+	for _, e := range entries {
+		if e.Err != nil || e.Key != "photos/"+e.Path {
+			t.Fatalf("unexpected entry %s at %s: %v", e.Key, e.Path, e.Err)
+		}
+	}
+	if _, _, err := fs.SyncPrefix(bg, filepath.Dir(dir)+"/", rs.SyncIndexOptions{}); !errors.Is(err, ErrOutsideRoot) {
+		t.Fatalf("expected a prefix outside the root to be rejected, got %v", err)
+	}
+
+	// a prefix which is not a directory keeps the last component
+	root, entries, err = fs.SyncPrefix(bg, "photos", rs.SyncIndexOptions{Chunker: "size-1024", CidVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || root.Cid().Version() != 1 {
+		t.Fatalf("expected 4 entries in a CIDv1 directory, got %d %s", len(entries), root.Cid())
+	}
+	if !bytes.Equal(read(root, "photos2/d.jpg"), contents["photos2/d.jpg"]) {
+		t.Fatal("unexpected content of photos2/d.jpg")
+	}
+
+	// large directories are sharded
+	defer func(size int) { uio.HAMTShardingSize = size }(uio.HAMTShardingSize)
+	uio.HAMTShardingSize = 256
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("many/%02d", i)
+		if err := os.MkdirAll(filepath.Join(dir, "many"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = []byte(name)
+		if err := os.WriteFile(filepath.Join(dir, name), contents[name], 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, entries, err = fs.SyncPrefix(bg, "many/", rs.SyncIndexOptions{})
+	if err != nil || len(entries) != 20 {
+		t.Fatalf("expected 20 entries, got %d %v", len(entries), err)
+	}
+	fsn, err := unixfs.ExtractFSNode(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != unixfs.THAMTShard {
+		t.Fatalf("expected a sharded directory, got %s", fsn.Type())
+	}
+	for _, e := range entries {
+		if !bytes.Equal(read(root, e.Path), contents[e.Key]) {
+			t.Fatalf("unexpected content of %s", e.Path)
+		}
+	}
+
+	// the source must be able to list its objects
+	_, fs = newTestStore(t, testStore{wrap: func(s *Source) rs.RemoteSource { return &countingSource{RemoteSource: s} }})
+	if _, _, err := fs.SyncPrefix(bg, "photos/", rs.SyncIndexOptions{}); !errors.Is(err, rs.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
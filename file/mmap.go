@@ -0,0 +1,63 @@
+package file
+
+import (
+	"context"
+	"io"
+	"os"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+)
+
+var _ rs.ViewSource = (*Source)(nil)
+
+// WithMmap serves ViewPart from memory mappings of the files, keeping up to
+// limit bytes mapped. The least recently used mappings are unmapped first,
+// once no reader uses them anymore. Files larger than limit are not
+// mapped but read normally.
+func WithMmap(limit int64) Option {
+	return func(s *Source) {
+		if limit > 0 && mmapSupported {
+			s.maps = newPool(s.root, limit, func(rel string) ([]byte, os.FileInfo, int64, error) {
+				return openMapping(s.openRel, rel, limit)
+			}, closeMapping)
+		}
+	}
+}
+
+// MmapStats returns the statistics of the mappings, zero if the source does
+// not map files.
+func (s *Source) MmapStats() PoolStats {
+	if s.maps == nil {
+		return PoolStats{}
+	}
+	return s.maps.Stats()
+}
+
+// ViewPart calls fn with a part of the mapping of the file. A file truncated
+// while being viewed is reported as StatusFileChanged.
+func (s *Source) ViewPart(ctx context.Context, key string, offset uint64, size uint64, fn func([]byte) error) error {
+	if s.maps == nil {
+		return rs.ErrNotSupported
+	}
+
+	rel, ok := s.relPath(key)
+	if !ok {
+		return errOutsideRoot()
+	}
+
+	m, err := s.maps.acquire(rel)
+	if err != nil {
+		return err
+	}
+	defer s.maps.release(m)
+
+	data := m.value
+	if offset > uint64(len(data)) || size > uint64(len(data))-offset {
+		return &rs.CorruptReferenceError{
+			Code: rs.StatusFileChanged,
+			Err:  io.ErrUnexpectedEOF,
+		}
+	}
+
+	return viewMapping(data[offset:offset+size], fn)
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package file
+
+import (
+	"os"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+)
+
+const mmapSupported = false
+
+func openMapping(open func(string) (*os.File, error), path string, limit int64) ([]byte, os.FileInfo, int64, error) {
+	return nil, nil, 0, rs.ErrNotSupported
+}
+
+func closeMapping(data []byte) {}
+
+func viewMapping(data []byte, fn func([]byte) error) error {
+	return fn(data)
+}
@@ -0,0 +1,70 @@
+//go:build unix
+
+package file
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"syscall"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+)
+
+const mmapSupported = true
+
+// openMapping maps the file at path, unless it is larger than limit, in
+// which case it returns rs.ErrNotSupported so that it is read normally.
+func openMapping(open func(string) (*os.File, error), path string, limit int64) ([]byte, os.FileInfo, int64, error) {
+	file, err := open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, 0, fileError(err)
+	}
+
+	size := info.Size()
+	if size == 0 {
+		return nil, info, 0, nil
+	}
+	if size > limit || int64(int(size)) != size {
+		return nil, nil, 0, rs.ErrNotSupported
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, 0, fileError(err)
+	}
+
+	return data, info, size, nil
+}
+
+func closeMapping(data []byte) {
+	if len(data) > 0 {
+		_ = syscall.Munmap(data)
+	}
+}
+
+// viewMapping calls fn with data, turning the fault raised when accessing
+// the pages of a file truncated underneath the mapping into an error.
+func viewMapping(data []byte, fn func([]byte) error) (err error) {
+	old := debug.SetPanicOnFault(true)
+	defer func() {
+		debug.SetPanicOnFault(old)
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Addr() uintptr }); !ok {
+				panic(r)
+			}
+			err = &rs.CorruptReferenceError{
+				Code: rs.StatusFileChanged,
+				Err:  fmt.Errorf("mapped file changed: %v", r),
+			}
+		}
+	}()
+
+	return fn(data)
+}
@@ -0,0 +1,206 @@
+package file
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PoolStats reports the activity of a pool of a Source.
+type PoolStats struct {
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64
+	Evictions     uint64
+	Open          int
+}
+
+// HitRate returns the share of reads served by an already open entry.
+func (s PoolStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+type poolEntry[T any] struct {
+	path   string
+	value  T
+	info   os.FileInfo
+	weight int64
+
+	// refs counts the readers using the entry, it is closed once it left
+	// the pool and refs dropped to zero.
+	refs    int
+	removed bool
+}
+
+// pool is a bounded LRU of resources opened from files, like handles or
+// mappings. The entries are shared by concurrent readers, and reopened when
+// their file changes.
+type pool[T any] struct {
+	root    string
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   PoolStats
+
+	// open returns the resource of the path relative to the root, the info
+	// of the opened file and the weight of the resource in the pool.
+	open  func(rel string) (T, os.FileInfo, int64, error)
+	close func(T)
+}
+
+func newPool[T any](root string, limit int64, open func(string) (T, os.FileInfo, int64, error), close func(T)) *pool[T] {
+	return &pool[T]{
+		root:    root,
+		limit:   limit,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		open:    open,
+		close:   close,
+	}
+}
+
+// sameFile reports whether the entry still refers to the file at its path,
+// i.e. whether the file was neither replaced nor modified since it was
+// opened.
+func sameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// acquire returns the entry of the path relative to the root. The caller
+// must release it.
+func (p *pool[T]) acquire(path string) (*poolEntry[T], error) {
+	info, err := os.Stat(filepath.Join(p.root, path))
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	p.mu.Lock()
+	if e, ok := p.entries[path]; ok {
+		pe := e.Value.(*poolEntry[T])
+		if sameFile(pe.info, info) {
+			p.stats.Hits++
+			pe.refs++
+			p.lru.MoveToFront(e)
+			p.mu.Unlock()
+			return pe, nil
+		}
+		p.stats.Invalidations++
+		p.remove(e)
+	}
+	p.stats.Misses++
+	p.mu.Unlock()
+
+	value, info, weight, err := p.open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pe := &poolEntry[T]{path: path, value: value, info: info, weight: weight, refs: 1}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[path]; ok {
+		// opened concurrently, keep the newest
+		p.remove(e)
+	}
+	p.entries[path] = p.lru.PushFront(pe)
+	p.used += weight
+	for p.used > p.limit && p.lru.Len() > 1 {
+		p.stats.Evictions++
+		p.remove(p.lru.Back())
+	}
+
+	return pe, nil
+}
+
+func (p *pool[T]) release(pe *poolEntry[T]) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pe.refs--
+	if pe.removed && pe.refs == 0 {
+		p.close(pe.value)
+	}
+}
+
+// remove takes the entry out of the pool. It must be called with the lock
+// held.
+func (p *pool[T]) remove(e *list.Element) {
+	pe := p.lru.Remove(e).(*poolEntry[T])
+	delete(p.entries, pe.path)
+	p.used -= pe.weight
+	pe.removed = true
+	if pe.refs == 0 {
+		p.close(pe.value)
+	}
+}
+
+func (p *pool[T]) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Open = p.lru.Len()
+	return stats
+}
+
+// Close closes the pooled entries, the ones still in use are closed once
+// released.
+func (p *pool[T]) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.lru.Len() > 0 {
+		p.remove(p.lru.Back())
+	}
+	return nil
+}
+
+// newHandlePool returns a pool keeping up to size files open. The handles
+// are shared by concurrent readers, which only use ReadAt so they don't
+// share an offset.
+func newHandlePool(root string, size int, open func(string) (*os.File, error)) *pool[*os.File] {
+	return newPool(root, int64(size), func(path string) (*os.File, os.FileInfo, int64, error) {
+		return openHandle(open, path)
+	}, func(f *os.File) { f.Close() })
+}
+
+func openHandle(open func(string) (*os.File, error), path string) (*os.File, os.FileInfo, int64, error) {
+	file, err := open(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// stat the opened file rather than trusting the path, which may have
+	// been replaced in between
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, fileError(err)
+	}
+
+	return file, info, 1, nil
+}
+
+type pooledReader struct {
+	*io.SectionReader
+	pool *pool[*os.File]
+	h    *poolEntry[*os.File]
+	once sync.Once
+}
+
+func (r *pooledReader) Close() error {
+	r.once.Do(func() {
+		r.pool.release(r.h)
+	})
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/fs"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,7 +13,27 @@ import (
 	rs "github.com/Dreamacro/go-ds-remote"
 )
 
-var _ rs.RemoteSource = (*Source)(nil)
+var (
+	_ rs.StatSource    = (*Source)(nil)
+	_ rs.ListSource    = (*Source)(nil)
+	_ rs.KeyNormalizer = (*Source)(nil)
+)
+
+func init() {
+	rs.RegisterSource("file", open)
+}
+
+// open builds a Source from a `file:///root` uri.
+func open(ctx context.Context, u *url.URL, cred *rs.Credential) (rs.RemoteSource, error) {
+	root := u.Path
+	if u.Opaque != "" {
+		root = u.Opaque
+	}
+	if root == "" {
+		return nil, errors.New("missing root path")
+	}
+	return New(filepath.FromSlash(root)), nil
+}
 
 type limitReader struct {
 	f *os.File
@@ -35,48 +57,154 @@ func (l *limitReader) Close() error {
 }
 
 type Source struct {
-	root string
+	root     string
+	symlinks SymlinkPolicy
+	relative bool
+	pool     *pool[*os.File]
+	maps     *pool[[]byte]
 }
 
-func New(root string) *Source {
-	return &Source{root: root}
+type Option func(*Source)
+
+// WithHandlePool keeps up to size files open between reads, shared by
+// concurrent readers. A handle is reopened when the inode, size or mtime of
+// its file changes.
+func WithHandlePool(size int) Option {
+	return func(s *Source) {
+		if size > 0 {
+			s.pool = newHandlePool(s.root, size, s.openRel)
+		}
+	}
 }
 
-func (s *Source) isSubPath(path string) bool {
-	rel, err := filepath.Rel(s.root, path)
-	if err != nil {
-		return false
+func New(root string, opts ...Option) *Source {
+	s := &Source{root: root}
+
+	for _, opt := range opts {
+		opt(s)
 	}
 
-	return !strings.Contains(rel, "..")
+	return s
 }
 
-func (s *Source) getFile(abspath string) (*os.File, error) {
-	if !s.isSubPath(abspath) {
-		return nil, &rs.CorruptReferenceError{
-			Code: rs.StatusOtherError,
-			Err:  errors.New("file not in root path"),
+// PoolStats returns the statistics of the handle pool, zero if the source
+// has none.
+func (s *Source) PoolStats() PoolStats {
+	if s.pool == nil {
+		return PoolStats{}
+	}
+	return s.pool.Stats()
+}
+
+// Close closes the files kept open by the handle pool and unmaps the
+// mapped files.
+func (s *Source) Close() error {
+	if s.pool != nil {
+		s.pool.Close()
+	}
+	if s.maps != nil {
+		s.maps.Close()
+	}
+	return nil
+}
+
+// WithRelativeKeys treats every key as relative to the root, even the ones
+// starting with a slash, like the keys passed by mount.Source. References
+// to absolute paths must be migrated with RemoteManager.NormalizeReferences
+// before enabling it.
+func WithRelativeKeys() Option {
+	return func(s *Source) {
+		s.relative = true
+	}
+}
+
+// relPath returns the path of key relative to the root, if it is lexically
+// inside it. Keys are either absolute paths inside the root or paths
+// relative to it.
+func (s *Source) relPath(key string) (string, bool) {
+	var rel string
+	if s.relative || !filepath.IsAbs(key) {
+		rel = filepath.Clean(filepath.FromSlash(strings.TrimLeft(key, "/")))
+	} else {
+		var err error
+		rel, err = filepath.Rel(s.root, key)
+		if err != nil {
+			return "", false
 		}
 	}
 
-	file, err := os.Open(abspath)
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// NormalizeKey returns the key of the file relative to the root, which is
+// what references store so that the root can be moved.
+func (s *Source) NormalizeKey(key string) (string, error) {
+	rel, ok := s.relPath(key)
+	if !ok {
+		return "", errOutsideRoot()
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func errOutsideRoot() error {
+	return &rs.CorruptReferenceError{
+		Code: rs.StatusOtherError,
+		Err:  ErrOutsideRoot,
+	}
+}
+
+func fileError(err error) error {
 	if os.IsNotExist(err) {
-		return nil, &rs.CorruptReferenceError{
+		return &rs.CorruptReferenceError{
 			Code: rs.StatusFileNotFound,
 			Err:  err,
 		}
-	} else if err != nil {
-		return nil, &rs.CorruptReferenceError{
-			Code: rs.StatusFileError,
-			Err:  err,
-		}
 	}
+	return &rs.CorruptReferenceError{
+		Code: rs.StatusFileError,
+		Err:  err,
+	}
+}
+
+// getFile opens key, making sure it is inside the root according to the
+// symlink policy.
+func (s *Source) getFile(key string) (*os.File, error) {
+	rel, ok := s.relPath(key)
+	if !ok {
+		return nil, errOutsideRoot()
+	}
+
+	return s.openRel(rel)
+}
 
-	return file, nil
+func (s *Source) openRel(rel string) (*os.File, error) {
+	return openBeneath(s.root, rel, s.symlinks)
 }
 
-func (s *Source) GetPart(ctx context.Context, abspath string, offset uint64, size uint64) (io.ReadCloser, error) {
-	f, err := s.getFile(abspath)
+func (s *Source) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	if s.pool != nil {
+		rel, ok := s.relPath(key)
+		if !ok {
+			return nil, errOutsideRoot()
+		}
+
+		h, err := s.pool.acquire(rel)
+		if err != nil {
+			return nil, err
+		}
+
+		return &pooledReader{
+			SectionReader: io.NewSectionReader(h.value, int64(offset), int64(size)),
+			pool:          s.pool,
+			h:             h,
+		}, nil
+	}
+
+	f, err := s.getFile(key)
 	if err != nil {
 		return nil, err
 	}
@@ -92,8 +220,8 @@ func (s *Source) GetPart(ctx context.Context, abspath string, offset uint64, siz
 	return &limitReader{f: f, n: int64(size)}, nil
 }
 
-func (s *Source) Get(ctx context.Context, abspath string) (io.ReadCloser, uint64, error) {
-	file, err := s.getFile(abspath)
+func (s *Source) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
+	file, err := s.getFile(key)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -108,3 +236,75 @@ func (s *Source) Get(ctx context.Context, abspath string) (io.ReadCloser, uint64
 
 	return file, uint64(fi.Size()), nil
 }
+
+// Stat returns the size, mtime and identity of the file. They are recorded
+// when the file is indexed, so that a later change of the file is detected
+// without reading it.
+func (s *Source) Stat(ctx context.Context, key string) (*rs.ObjectInfo, error) {
+	file, err := s.getFile(key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, fileError(err)
+	}
+
+	info := &rs.ObjectInfo{
+		Size:    uint64(fi.Size()),
+		ModTime: fi.ModTime(),
+	}
+	info.Inode, info.Device = fileID(fi)
+	return info, nil
+}
+
+// List calls fn with the keys of the regular files beneath the root whose
+// key starts with prefix, in lexical order. The keys are relative to the
+// root, like the ones references store, and so is prefix once normalized
+// like a key up to its last slash.
+func (s *Source) List(ctx context.Context, prefix string, fn func(key string) error) error {
+	i := strings.LastIndex(prefix, "/") + 1
+	rel, ok := s.relPath(prefix[:i])
+	if !ok {
+		return errOutsideRoot()
+	}
+	if rel == "." {
+		prefix = prefix[i:]
+	} else {
+		prefix = filepath.ToSlash(rel) + "/" + prefix[i:]
+	}
+
+	start := filepath.Join(s.root, rel)
+	if _, err := os.Stat(start); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			// skip the directories which can't hold a key with prefix
+			if path != start && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(key)
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package file
+
+import "os"
+
+func fileID(fi os.FileInfo) (inode uint64, device uint64) {
+	return 0, 0
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileID(fi os.FileInfo) (inode uint64, device uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Ino), uint64(st.Dev)
+}
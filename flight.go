@@ -0,0 +1,112 @@
+package remotestore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// FetchStats reports the fetches of blocks from the source.
+type FetchStats struct {
+	// Fetches counts the blocks read from the source.
+	Fetches uint64
+	// Coalesced counts the requests served by the fetch of a concurrent
+	// request for the same block, which is the number of saved fetches.
+	Coalesced uint64
+}
+
+// FetchStats returns the fetches of blocks from the source by Get.
+func (f *RemoteManager) FetchStats() FetchStats {
+	return f.flight.stats()
+}
+
+// FetchStats returns the fetches of blocks from the source by Get.
+func (f *Remotestore) FetchStats() FetchStats {
+	return f.flight.stats()
+}
+
+// withCid returns b with the Cid c, since fetches are shared by the Cids
+// with the same multihash.
+func withCid(b blocks.Block, c cid.Cid) (blocks.Block, error) {
+	if b.Cid().Equals(c) {
+		return b, nil
+	}
+	return blocks.NewBlockWithCid(b.RawData(), c)
+}
+
+type flightCall struct {
+	done    chan struct{}
+	blk     blocks.Block
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces the concurrent fetches of the same block. The fetch
+// runs on behalf of all its waiters, it is only cancelled once all of them
+// are gone.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+
+	fetches, coalesced atomic.Uint64
+}
+
+func (g *flightGroup) stats() FetchStats {
+	return FetchStats{
+		Fetches:   g.fetches.Load(),
+		Coalesced: g.coalesced.Load(),
+	}
+}
+
+// do returns the block fetched by fn for key, joining the fetch in flight
+// for key if any.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (blocks.Block, error)) (blocks.Block, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, ok := g.calls[key]
+	if ok {
+		c.waiters++
+		g.coalesced.Add(1)
+	} else {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &flightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.calls[key] = c
+		g.fetches.Add(1)
+
+		go func() {
+			c.blk, c.err = fn(fctx)
+			cancel()
+
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.blk, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody is waiting for the fetch anymore
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
@@ -2,9 +2,13 @@ package remotestore
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	dshelp "github.com/ipfs/boxo/datastore/dshelp"
 	pb "github.com/ipfs/boxo/filestore/pb"
@@ -22,13 +26,60 @@ import (
 // RemotestorePrefix identifies the key prefix for FileManager blocks.
 var RemotestorePrefix = ds.NewKey("remotestore")
 
+// RemotestoreIndexPrefix identifies the key prefix for the index from keys
+// to the blocks referencing them.
+var RemotestoreIndexPrefix = ds.NewKey("remotestore-index")
+
+// RemotestoreLocationPrefix identifies the key prefix for the alternative
+// locations of blocks found in several objects.
+var RemotestoreLocationPrefix = ds.NewKey("remotestore-locations")
+
+// RemotestoreObjectPrefix identifies the key prefix for the fingerprints of
+// indexed objects.
+var RemotestoreObjectPrefix = ds.NewKey("remotestore-objects")
+
 // RemoteManager is a blockstore implementation which stores special
 // blocks FilestoreNode type. These nodes only contain a reference
 // to the actual location of the block data in the filesystem
 // (a path and an offset).
 type RemoteManager struct {
-	ds     ds.Batching
-	source RemoteSource
+	ds        ds.Batching
+	index     ds.Batching
+	locations ds.Batching
+	objects   ds.Batching
+	cached    ds.Datastore
+	migration ds.Datastore
+	source    RemoteSource
+	sourceID  string
+
+	// indexing holds the info of the objects being indexed by path.
+	indexing sync.Map
+
+	statCheck bool
+	flight    flightGroup
+
+	// root is the datastore shared by all namespaces.
+	root       ds.Datastore
+	namespace  string
+	registered atomic.Bool
+
+	watchers watchers
+
+	// writeMu is shared by the writes of references, and held alone by
+	// MigrateRecords while it upgrades a batch.
+	writeMu sync.RWMutex
+}
+
+type ManagerOption func(*RemoteManager)
+
+// WithStatCheck makes Get compare the object of a block with the
+// fingerprint recorded when it was indexed before reading anything, and
+// fail with StatusFileChanged or StatusFileNotFound if it changed or
+// disappeared. Objects without fingerprint are read as usual.
+func WithStatCheck() ManagerOption {
+	return func(f *RemoteManager) {
+		f.statCheck = true
+	}
 }
 
 // CorruptReferenceError implements the error interface.
@@ -46,14 +97,40 @@ func (c CorruptReferenceError) Error() string {
 	return c.Err.Error()
 }
 
+// Unwrap returns the underlying error.
+func (c CorruptReferenceError) Unwrap() error {
+	return c.Err
+}
+
 // NewRemoteManager initializes a new file manager with the given
 // datastore and root. All FilestoreNodes paths are relative to the
 // root path given here, which is prepended for any operations.
-func NewRemoteManager(ds ds.Batching, source RemoteSource) *RemoteManager {
-	return &RemoteManager{
-		ds:     dsns.Wrap(ds, RemotestorePrefix),
+func NewRemoteManager(ds ds.Batching, source RemoteSource, opts ...ManagerOption) *RemoteManager {
+	f := &RemoteManager{
+		root:   ds,
 		source: source,
 	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	if f.namespace != "" {
+		ds = dsns.Wrap(ds, RemotestoreNamespacePrefix.Child(namespaceKey(f.namespace)))
+	}
+	f.ds = dsns.Wrap(ds, RemotestorePrefix)
+	f.index = dsns.Wrap(ds, RemotestoreIndexPrefix)
+	f.locations = dsns.Wrap(ds, RemotestoreLocationPrefix)
+	f.objects = dsns.Wrap(ds, RemotestoreObjectPrefix)
+	f.cached = dsns.Wrap(ds, RemotestoreCachePrefix)
+	f.migration = dsns.Wrap(ds, RemotestoreMigrationPrefix)
+
+	return f
+}
+
+// Source returns the RemoteSource the referenced data is read from.
+func (f *RemoteManager) Source() RemoteSource {
+	return f.source
 }
 
 // AllKeysChan returns a channel from which to read the keys stored in
@@ -96,26 +173,70 @@ func (f *RemoteManager) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error)
 	return out, nil
 }
 
-// DeleteBlock deletes the reference-block from the underlying
-// datastore. It does not touch the referenced data.
+// DeleteBlock deletes the reference-block, with all its locations, from
+// the underlying datastore. It does not touch the referenced data.
 func (f *RemoteManager) DeleteBlock(ctx context.Context, c cid.Cid) error {
-	err := f.ds.Delete(ctx, dshelp.MultihashToDsKey(c.Hash()))
+	f.writeMu.RLock()
+	defer f.writeMu.RUnlock()
+
+	// a corrupt reference can still be deleted, it just has no index entry
+	dobj, err := f.getDataObj(ctx, c.Hash())
+	if ipld.IsNotFound(err) {
+		return err
+	}
+
+	err = f.ds.Delete(ctx, dshelp.MultihashToDsKey(c.Hash()))
 	if err == ds.ErrNotFound {
 		return ipld.ErrNotFound{Cid: c}
+	} else if err != nil {
+		return err
 	}
-	return err
+
+	if dobj != nil {
+		if err := f.index.Delete(ctx, indexKey(dobj.GetFilePath(), c.Hash())); err != nil {
+			return err
+		}
+	}
+
+	alts, err := f.alternates(ctx, c.Hash())
+	if err != nil {
+		return err
+	}
+	for _, alt := range alts {
+		if err := f.locations.Delete(ctx, locationKey(c.Hash(), alt.GetFilePath())); err != nil {
+			return err
+		}
+		if err := f.index.Delete(ctx, indexKey(alt.GetFilePath(), c.Hash())); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Get reads a block from the datastore. Reading a block
 // is done in two steps: the first step retrieves the reference
 // block from the datastore. The second step uses the stored
 // path and offsets to read the raw block data directly from disk.
+// When that fails, the alternative locations of the block are tried in
+// turn, and the error of the first location is returned if none works.
+// Concurrent requests for the same block share a single read.
 func (f *RemoteManager) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
-	dobj, err := f.getDataObj(ctx, c.Hash())
+	blk, err := f.flight.do(ctx, string(c.Hash()), func(ctx context.Context) (blocks.Block, error) {
+		return f.get(ctx, c)
+	})
 	if err != nil {
 		return nil, err
 	}
-	out, err := f.readDataObj(ctx, c.Hash(), dobj)
+	return withCid(blk, c)
+}
+
+func (f *RemoteManager) get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	var out []byte
+	err := f.View(ctx, c, func(data []byte) error {
+		out = append([]byte(nil), data...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -123,6 +244,67 @@ func (f *RemoteManager) Get(ctx context.Context, c cid.Cid) (blocks.Block, error
 	return blocks.NewBlockWithCid(out, c)
 }
 
+// View is like Get, but calls fn with the block data instead of copying
+// it, straight from the memory of the source when it is a ViewSource and
+// from a pooled buffer otherwise. The data is only valid during the call.
+// Errors returned by fn are returned as is.
+func (f *RemoteManager) View(ctx context.Context, c cid.Cid, fn func([]byte) error) error {
+	dobj, err := f.getDataObj(ctx, c.Hash())
+	if err != nil {
+		return err
+	}
+
+	called := false
+	view := func(data []byte) error {
+		called = true
+		return fn(data)
+	}
+
+	err = f.viewLocation(ctx, c.Hash(), dobj, view)
+	if err == nil || called || ctx.Err() != nil {
+		return err
+	}
+
+	alts, aerr := f.alternates(ctx, c.Hash())
+	if aerr != nil {
+		logger.Errorf("listing locations of %s: %s", c, aerr)
+	}
+	for _, alt := range alts {
+		aerr := f.viewLocation(ctx, c.Hash(), alt, view)
+		if aerr == nil {
+			logger.Debugf("read %s from %s: %s", c, alt.GetFilePath(), err)
+		}
+		if aerr == nil || called {
+			return aerr
+		}
+	}
+	return err
+}
+
+func (f *RemoteManager) viewLocation(ctx context.Context, m mh.Multihash, d *pb.DataObj, fn func([]byte) error) error {
+	if f.statCheck {
+		if check := f.checkObject(ctx, d.GetFilePath(), false); check.err != nil {
+			return check.err
+		}
+	}
+
+	err := f.viewDataObj(ctx, m, d, fn)
+	if err != ErrNotSupported {
+		return err
+	}
+
+	buf := getBuffer(d.GetSize())
+	defer putBuffer(buf)
+
+	if err := f.readPart(ctx, d, *buf); err != nil {
+		return err
+	}
+	if err := verifyData(m, d, *buf); err != nil {
+		return err
+	}
+	return fn(*buf)
+}
+
 // GetSize gets the size of the block from the datastore.
 //
 // This method may successfully return the size even if returning the block
@@ -136,38 +318,122 @@ func (f *RemoteManager) GetSize(ctx context.Context, c cid.Cid) (int, error) {
 }
 
 func (f *RemoteManager) readDataObj(ctx context.Context, m mh.Multihash, d *pb.DataObj) ([]byte, error) {
+	var outbuf []byte
+	err := f.viewDataObj(ctx, m, d, func(data []byte) error {
+		outbuf = append([]byte(nil), data...)
+		return nil
+	})
+	if err != ErrNotSupported {
+		return outbuf, err
+	}
+
+	return f.copyDataObj(ctx, m, d)
+}
+
+// viewDataObj calls fn with the verified block data of d, straight from
+// the memory of the source. It returns ErrNotSupported when the source
+// can't expose the data.
+func (f *RemoteManager) viewDataObj(ctx context.Context, m mh.Multihash, d *pb.DataObj, fn func([]byte) error) error {
+	vs, ok := f.source.(ViewSource)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	fullpath := filepath.FromSlash(d.GetFilePath())
+	viewed := false
+	err := vs.ViewPart(ctx, fullpath, d.GetOffset(), d.GetSize(), func(data []byte) error {
+		viewed = true
+		if uint64(len(data)) != d.GetSize() {
+			return &CorruptReferenceError{StatusFileChanged, io.ErrUnexpectedEOF}
+		}
+		if err := verifyData(m, d, data); err != nil {
+			return err
+		}
+		return fn(data)
+	})
+	switch {
+	case err == nil:
+		return nil
+	case !viewed && errors.Is(err, ErrNotSupported):
+		return ErrNotSupported
+	case errors.As(err, new(*CorruptReferenceError)):
+		return err
+	case viewed:
+		// returned by fn
+		return err
+	default:
+		return &CorruptReferenceError{StatusFileError, err}
+	}
+}
+
+func (f *RemoteManager) copyDataObj(ctx context.Context, m mh.Multihash, d *pb.DataObj) ([]byte, error) {
+	outbuf := make([]byte, d.GetSize())
+	if err := f.readPart(ctx, d, outbuf); err != nil {
+		return nil, err
+	}
+
+	if err := verifyData(m, d, outbuf); err != nil {
+		return nil, err
+	}
+
+	return outbuf, nil
+}
+
+// readPart reads the part of the source referenced by d into buf, which
+// holds d.Size bytes.
+func (f *RemoteManager) readPart(ctx context.Context, d *pb.DataObj, buf []byte) error {
 	fullpath := filepath.FromSlash(d.GetFilePath())
 
 	reader, err := f.source.GetPart(ctx, fullpath, d.GetOffset(), d.GetSize())
 	if err != nil {
-		return nil, &CorruptReferenceError{StatusFileError, err}
+		return &CorruptReferenceError{StatusFileError, err}
 	}
 	defer reader.Close()
 
-	outbuf := make([]byte, d.GetSize())
-	_, err = io.ReadFull(reader, outbuf)
+	_, err = io.ReadFull(reader, buf)
 	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, &CorruptReferenceError{StatusFileChanged, err}
+		return &CorruptReferenceError{StatusFileChanged, err}
 	} else if err != nil {
-		return nil, &CorruptReferenceError{StatusFileError, err}
+		return &CorruptReferenceError{StatusFileError, err}
 	}
+	return nil
+}
+
+// bufferPool holds the buffers View reads blocks into when the source
+// can't expose them in memory.
+var bufferPool sync.Pool
+
+func getBuffer(size uint64) *[]byte {
+	if buf, ok := bufferPool.Get().(*[]byte); ok && uint64(cap(*buf)) >= size {
+		*buf = (*buf)[:size]
+		return buf
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+func putBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
 
+// verifyData checks that data read for d hashes to m.
+func verifyData(m mh.Multihash, d *pb.DataObj, data []byte) error {
 	// Work with CIDs for this, as they are a nice wrapper and things
 	// will not break if multihashes underlying types change.
 	origCid := cid.NewCidV1(cid.Raw, m)
-	outcid, err := origCid.Prefix().Sum(outbuf)
+	outcid, err := origCid.Prefix().Sum(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if !origCid.Equals(outcid) {
-		return nil, &CorruptReferenceError{
+		return &CorruptReferenceError{
 			StatusFileChanged,
 			fmt.Errorf("data in file did not match. %s offset %d", d.GetFilePath(), d.GetOffset()),
 		}
 	}
 
-	return outbuf, nil
+	return nil
 }
 
 func (f *RemoteManager) getDataObj(ctx context.Context, m mh.Multihash) (*pb.DataObj, error) {
@@ -202,46 +468,354 @@ func (f *RemoteManager) Has(ctx context.Context, c cid.Cid) (bool, error) {
 	return f.ds.Has(ctx, dsk)
 }
 
-type putter interface {
-	Put(context.Context, ds.Key, []byte) error
+// NormalizeKey returns the canonical form of key, as stored in references.
+func (f *RemoteManager) NormalizeKey(key string) (string, error) {
+	kn, ok := f.source.(KeyNormalizer)
+	if !ok {
+		return key, nil
+	}
+	return kn.NormalizeKey(key)
+}
+
+// ObjectInfo returns the fingerprint recorded for the object at path when it
+// was indexed. It returns ds.ErrNotFound if there is none.
+func (f *RemoteManager) ObjectInfo(ctx context.Context, path string) (*ObjectInfo, error) {
+	path, err := f.NormalizeKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := f.objects.Get(ctx, objectKey(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var info ObjectInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// PutObjectInfo records the fingerprint of the object at path.
+func (f *RemoteManager) PutObjectInfo(ctx context.Context, path string, info *ObjectInfo) error {
+	path, err := f.NormalizeKey(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return f.objects.Put(ctx, objectKey(path), data)
+}
+
+func objectKey(path string) ds.Key {
+	return dshelp.NewKeyFromBinary([]byte(filepath.ToSlash(path)))
+}
+
+// refWriter holds where the parts of a reference are written, the
+// datastores themselves or batches of them.
+type refWriter struct {
+	refs      ds.Write
+	index     ds.Write
+	locations ds.Write
 }
 
 // Put adds a new reference block to the FileManager. It does not check
-// that the reference is valid.
+// that the reference is valid. A block already referencing another key
+// keeps it, and gains the new one as an alternative location.
 func (f *RemoteManager) Put(ctx context.Context, b *posinfo.FilestoreNode) error {
-	return f.putTo(ctx, b, f.ds)
-}
+	if err := f.register(ctx); err != nil {
+		return err
+	}
 
-func (f *RemoteManager) putTo(ctx context.Context, b *posinfo.FilestoreNode, to putter) error {
-	var dobj pb.DataObj
+	f.writeMu.RLock()
+	defer f.writeMu.RUnlock()
 
-	filePath := filepath.ToSlash(b.PosInfo.FullPath)
-	dobj.FilePath = &filePath
-	dobj.Offset = &b.PosInfo.Offset
-	size := uint64(len(b.RawData()))
-	dobj.Size = &size
+	// the index is written first, a missing reference is less harmful than
+	// a reference missing from the index
+	if err := f.putTo(ctx, b, refWriter{f.ds, f.index, f.locations}, nil); err != nil {
+		return err
+	}
+	f.written(b.Cid().Hash())
+	return nil
+}
 
-	data, err := proto.Marshal(&dobj)
+// putTo writes the reference of b to w. pending holds the keys referenced
+// by the blocks written to w but not committed yet, if w is a batch.
+func (f *RemoteManager) putTo(ctx context.Context, b *posinfo.FilestoreNode, w refWriter, pending map[string]string) error {
+	key, err := f.NormalizeKey(b.PosInfo.FullPath)
 	if err != nil {
 		return err
 	}
 
-	return to.Put(ctx, dshelp.MultihashToDsKey(b.Cid().Hash()), data)
+	rec := f.newRecord(filepath.ToSlash(key), b.PosInfo.Offset, uint64(len(b.RawData())))
+	return f.putRef(ctx, b.Cid().Hash(), rec, w, pending)
+}
+
+// putRef writes the record rec of the block m to w, see putTo.
+func (f *RemoteManager) putRef(ctx context.Context, m mh.Multihash, rec *Record, w refWriter, pending map[string]string) error {
+	filePath := rec.Path
+	data := marshalRecord(rec)
+
+	primary, ok := pending[string(m)]
+	if !ok {
+		if old, err := f.getDataObj(ctx, m); err == nil {
+			primary = old.GetFilePath()
+		}
+	}
+
+	if err := f.indexPut(ctx, w.index, m, rec.dataObj()); err != nil {
+		return err
+	}
+
+	if primary != "" && primary != filePath {
+		return w.locations.Put(ctx, locationKey(m, filePath), data)
+	}
+
+	if pending != nil {
+		pending[string(m)] = filePath
+	}
+	return w.refs.Put(ctx, dshelp.MultihashToDsKey(m), data)
 }
 
 // PutMany is like Put() but takes a slice of blocks instead,
 // allowing it to create a batch transaction.
 func (f *RemoteManager) PutMany(ctx context.Context, bs []*posinfo.FilestoreNode) error {
+	if err := f.register(ctx); err != nil {
+		return err
+	}
+
+	f.writeMu.RLock()
+	defer f.writeMu.RUnlock()
+
 	batch, err := f.ds.Batch(ctx)
 	if err != nil {
 		return err
 	}
 
+	index, err := f.index.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	locations, err := f.locations.Batch(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := refWriter{batch, index, locations}
+	pending := make(map[string]string)
+	for _, b := range bs {
+		if err := f.putTo(ctx, b, w, pending); err != nil {
+			return err
+		}
+	}
+
+	if err := index.Commit(ctx); err != nil {
+		return err
+	}
+
+	if err := locations.Commit(ctx); err != nil {
+		return err
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return err
+	}
 	for _, b := range bs {
-		if err := f.putTo(ctx, b, batch); err != nil {
+		f.written(b.Cid().Hash())
+	}
+	return nil
+}
+
+// NormalizeReferences rewrites the references, alternative locations and
+// fingerprints whose key is not in the canonical form of the source, e.g.
+// the absolute paths recorded by a file.Source before it stored paths
+// relative to its root. Keys the source rejects are left untouched. It
+// returns the number of rewritten references.
+func (f *RemoteManager) NormalizeReferences(ctx context.Context) (int, error) {
+	if _, ok := f.source.(KeyNormalizer); !ok {
+		return 0, nil
+	}
+
+	const batchSize = 1024
+
+	qr, err := f.ds.Query(ctx, dsq.Query{})
+	if err != nil {
+		return 0, err
+	}
+	defer qr.Close()
+
+	batch, err := f.ds.Batch(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		r, ok := qr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return count, r.Error
+		}
+
+		dobj, err := unmarshalDataObj(r.Value)
+		if err != nil {
+			logger.Warnf("skipping corrupt reference %s: %s", r.Key, err)
+			continue
+		}
+
+		key, err := f.NormalizeKey(filepath.FromSlash(dobj.GetFilePath()))
+		if err != nil {
+			logger.Warnf("skipping reference %s: %s", r.Key, err)
+			continue
+		}
+
+		filePath := filepath.ToSlash(key)
+		if filePath == dobj.GetFilePath() {
+			continue
+		}
+		dobj.FilePath = &filePath
+
+		data, err := proto.Marshal(dobj)
+		if err != nil {
+			return count, err
+		}
+		if err := batch.Put(ctx, ds.RawKey(r.Key), data); err != nil {
+			return count, err
+		}
+
+		count++
+		if count%batchSize == 0 {
+			if err := batch.Commit(ctx); err != nil {
+				return count, err
+			}
+			if batch, err = f.ds.Batch(ctx); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return count, err
+	}
+
+	n, err := f.normalizeLocations(ctx)
+	count += n
+	if err != nil {
+		return count, err
+	}
+
+	if err := f.normalizeObjects(ctx); err != nil {
+		return count, err
+	}
+
+	if count > 0 {
+		if _, err := f.RebuildKeyIndex(ctx); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// normalizeLocations moves the alternative locations to their normalized
+// key. It must run after the references were normalized, a location which
+// turns out to be the reference of its block is dropped.
+func (f *RemoteManager) normalizeLocations(ctx context.Context) (int, error) {
+	qr, err := f.locations.Query(ctx, dsq.Query{})
+	if err != nil {
+		return 0, err
+	}
+
+	entries, err := qr.Rest()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, e := range entries {
+		m, err := dshelp.DsKeyToMultihash(ds.NewKey(ds.RawKey(e.Key).List()[0]))
+		if err != nil {
+			logger.Warnf("skipping location %s: %s", e.Key, err)
+			continue
+		}
+		dobj, err := unmarshalDataObj(e.Value)
+		if err != nil {
+			logger.Warnf("skipping corrupt location %s: %s", e.Key, err)
+			continue
+		}
+
+		key, err := f.NormalizeKey(filepath.FromSlash(dobj.GetFilePath()))
+		if err != nil {
+			logger.Warnf("skipping location %s: %s", e.Key, err)
+			continue
+		}
+
+		filePath := filepath.ToSlash(key)
+		if filePath == dobj.GetFilePath() {
+			continue
+		}
+
+		primary, err := f.getDataObj(ctx, m)
+		if err != nil && !ipld.IsNotFound(err) {
+			return count, err
+		}
+		if primary == nil || primary.GetFilePath() != filePath {
+			dobj.FilePath = &filePath
+			data, err := proto.Marshal(dobj)
+			if err != nil {
+				return count, err
+			}
+			if err := f.locations.Put(ctx, locationKey(m, filePath), data); err != nil {
+				return count, err
+			}
+		}
+		if err := f.locations.Delete(ctx, ds.RawKey(e.Key)); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (f *RemoteManager) normalizeObjects(ctx context.Context) error {
+	qr, err := f.objects.Query(ctx, dsq.Query{})
+	if err != nil {
+		return err
+	}
+
+	entries, err := qr.Rest()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		path, err := dshelp.BinaryFromDsKey(ds.RawKey(e.Key))
+		if err != nil {
+			continue
+		}
+
+		key, err := f.NormalizeKey(filepath.FromSlash(string(path)))
+		if err != nil || filepath.ToSlash(key) == string(path) {
+			continue
+		}
+
+		if err := f.objects.Put(ctx, objectKey(key), e.Value); err != nil {
+			return err
+		}
+		if err := f.objects.Delete(ctx, ds.RawKey(e.Key)); err != nil {
 			return err
 		}
 	}
 
-	return batch.Commit(ctx)
+	return nil
 }
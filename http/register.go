@@ -0,0 +1,33 @@
+package http
+
+import (
+	"context"
+	nethttp "net/http"
+	"net/url"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+	"github.com/samber/oops"
+)
+
+func init() {
+	rs.RegisterSource("http", open)
+	rs.RegisterSource("https", open)
+}
+
+// open builds a source from an uri of the form `https://host/base/path`,
+// the keys being read under the path. A credential authenticates the
+// requests with HTTP basic authentication.
+func open(ctx context.Context, u *url.URL, cred *rs.Credential) (rs.RemoteSource, error) {
+	if u.Host == "" {
+		return nil, oops.Errorf("%s uri without host", u.Scheme)
+	}
+
+	base := *u
+	base.RawQuery, base.Fragment = "", ""
+
+	var opts []Option
+	if cred != nil {
+		opts = append(opts, WithCredential(cred))
+	}
+	return New(nethttp.DefaultClient, &base, opts...), nil
+}
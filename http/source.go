@@ -0,0 +1,156 @@
+// Package http reads the objects of a remote store over HTTP(S), the key of
+// an object being its path under a base URL.
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+	"github.com/samber/oops"
+)
+
+var _ rs.StatSource = (*Source)(nil)
+
+type Source struct {
+	client *nethttp.Client
+	base   *url.URL
+	cred   *rs.Credential
+}
+
+type Option func(*Source)
+
+// WithCredential authenticates the requests with HTTP basic authentication,
+// the access key ID being the user and the secret access key the password.
+func WithCredential(cred *rs.Credential) Option {
+	return func(s *Source) {
+		s.cred = cred
+	}
+}
+
+func New(client *nethttp.Client, base *url.URL, opts ...Option) *Source {
+	s := &Source{
+		client: client,
+		base:   base,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func (s *Source) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	if size == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	header := nethttp.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	resp, err := s.do(ctx, nethttp.MethodGet, key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case nethttp.StatusPartialContent:
+		return resp.Body, nil
+	case nethttp.StatusOK:
+		// the server ignored the range, skip to the part
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+			resp.Body.Close()
+			return nil, oops.Wrapf(err, "failed to skip to offset %d of %s", offset, key)
+		}
+		return &limitReadCloser{Reader: io.LimitReader(resp.Body, int64(size)), Closer: resp.Body}, nil
+	default:
+		resp.Body.Close()
+		return nil, responseError(resp, key)
+	}
+}
+
+func (s *Source) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
+	resp, err := s.do(ctx, nethttp.MethodGet, key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != nethttp.StatusOK {
+		resp.Body.Close()
+		return nil, 0, responseError(resp, key)
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, 0, oops.Errorf("unknown size of object %s", key)
+	}
+
+	return resp.Body, uint64(resp.ContentLength), nil
+}
+
+// Stat describes the object with the headers of a HEAD request.
+func (s *Source) Stat(ctx context.Context, key string) (*rs.ObjectInfo, error) {
+	resp, err := s.do(ctx, nethttp.MethodHead, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, responseError(resp, key)
+	}
+	if resp.ContentLength < 0 {
+		return nil, oops.Errorf("unknown size of object %s", key)
+	}
+
+	info := &rs.ObjectInfo{
+		Size: uint64(resp.ContentLength),
+		ETag: resp.Header.Get("ETag"),
+	}
+	if modified := resp.Header.Get("Last-Modified"); modified != "" {
+		if t, err := nethttp.ParseTime(modified); err == nil {
+			info.ModTime = t
+		}
+	}
+	return info, nil
+}
+
+// do sends a request for the object key.
+func (s *Source) do(ctx context.Context, method, key string, header nethttp.Header) (*nethttp.Response, error) {
+	req, err := nethttp.NewRequestWithContext(ctx, method, s.base.JoinPath(key).String(), nil)
+	if err != nil {
+		return nil, oops.Wrapf(err, "failed to create request for object %s", key)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.cred != nil {
+		req.SetBasicAuth(s.cred.AccessKeyID, s.cred.SecretAccessKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, oops.Wrapf(err, "failed to request object %s", key)
+	}
+	return resp, nil
+}
+
+// responseError returns the error of an unexpected response, a
+// CorruptReferenceError with StatusFileNotFound for a missing object.
+func responseError(resp *nethttp.Response, key string) error {
+	err := fmt.Errorf("object %s: unexpected status %s", key, resp.Status)
+	if resp.StatusCode == nethttp.StatusNotFound || resp.StatusCode == nethttp.StatusGone {
+		return &rs.CorruptReferenceError{
+			Code: rs.StatusFileNotFound,
+			Err:  err,
+		}
+	}
+	return err
+}
+
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
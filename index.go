@@ -0,0 +1,292 @@
+package remotestore
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"path/filepath"
+	"slices"
+
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	pb "github.com/ipfs/boxo/filestore/pb"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	mh "github.com/multiformats/go-multihash"
+	proto "google.golang.org/protobuf/proto"
+)
+
+// KeyRef is a block referencing a part of a key.
+type KeyRef struct {
+	Cid    cid.Cid
+	Offset uint64
+	Size   uint64
+}
+
+// indexKey returns the index entry of the block m referencing path. The
+// entries of a path share the prefix objectKey(path).
+func indexKey(path string, m mh.Multihash) ds.Key {
+	return objectKey(path).Child(dshelp.MultihashToDsKey(m))
+}
+
+// indexPut records that the block m has the location d.
+func (f *RemoteManager) indexPut(ctx context.Context, index ds.Write, m mh.Multihash, d *pb.DataObj) error {
+	entry := pb.DataObj{
+		Offset: d.Offset,
+		Size:   d.Size,
+	}
+	data, err := proto.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	return index.Put(ctx, indexKey(d.GetFilePath(), m), data)
+}
+
+// ListByKey returns the blocks referencing key, ordered by offset.
+func (f *RemoteManager) ListByKey(ctx context.Context, key string) ([]KeyRef, error) {
+	key, err := f.NormalizeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	qr, err := f.index.Query(ctx, dsq.Query{Prefix: objectKey(key).String()})
+	if err != nil {
+		return nil, err
+	}
+	defer qr.Close()
+
+	var refs []KeyRef
+	for {
+		r, ok := qr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		m, err := dshelp.DsKeyToMultihash(ds.NewKey(ds.RawKey(r.Key).BaseNamespace()))
+		if err != nil {
+			logger.Errorf("decoding multihash from index: %s", err)
+			continue
+		}
+
+		entry, err := unmarshalDataObj(r.Value)
+		if err != nil {
+			logger.Errorf("decoding index entry %s: %s", r.Key, err)
+			continue
+		}
+
+		refs = append(refs, KeyRef{
+			Cid:    cid.NewCidV1(cid.Raw, m),
+			Offset: entry.GetOffset(),
+			Size:   entry.GetSize(),
+		})
+	}
+
+	slices.SortFunc(refs, func(a, b KeyRef) int {
+		if c := cmp.Compare(a.Offset, b.Offset); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.Cid.Bytes(), b.Cid.Bytes())
+	})
+	return refs, nil
+}
+
+// RemoveByKey removes the locations in key, e.g. once the object is
+// deleted from the source, and its recorded fingerprint. Blocks found in
+// other objects as well are kept. It returns the number of removed
+// locations.
+func (f *RemoteManager) RemoveByKey(ctx context.Context, key string) (int, error) {
+	key, err := f.NormalizeKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	refs, err := f.ListByKey(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	path := filepath.ToSlash(key)
+	count := 0
+	for _, ref := range refs {
+		removed, err := f.removeLocation(ctx, ref.Cid.Hash(), path)
+		if err != nil {
+			return count, err
+		}
+		if removed {
+			count++
+		}
+	}
+
+	if err := f.objects.Delete(ctx, objectKey(path)); err != nil {
+		return count, err
+	}
+
+	return count, nil
+}
+
+// RenameKey points the locations in from at to instead, e.g. once the
+// object is moved in the source, along with its recorded fingerprint. It
+// returns the number of renamed locations.
+func (f *RemoteManager) RenameKey(ctx context.Context, from, to string) (int, error) {
+	from, err := f.NormalizeKey(from)
+	if err != nil {
+		return 0, err
+	}
+	to, err = f.NormalizeKey(to)
+	if err != nil {
+		return 0, err
+	}
+
+	refs, err := f.ListByKey(ctx, from)
+	if err != nil {
+		return 0, err
+	}
+
+	fromPath, toPath := filepath.ToSlash(from), filepath.ToSlash(to)
+	if fromPath == toPath {
+		return 0, nil
+	}
+
+	count := 0
+	for _, ref := range refs {
+		moved, err := f.moveLocation(ctx, ref.Cid.Hash(), fromPath, toPath)
+		if err != nil {
+			return count, err
+		}
+		if moved {
+			count++
+		}
+	}
+
+	data, err := f.objects.Get(ctx, objectKey(fromPath))
+	switch err {
+	case nil:
+		if err := f.objects.Put(ctx, objectKey(toPath), data); err != nil {
+			return count, err
+		}
+		if err := f.objects.Delete(ctx, objectKey(fromPath)); err != nil {
+			return count, err
+		}
+	case ds.ErrNotFound:
+	default:
+		return count, err
+	}
+
+	return count, nil
+}
+
+// RebuildKeyIndex rebuilds the index from keys to blocks out of the
+// references and their alternative locations, e.g. for datastores written
+// before it existed. It returns the number of indexed locations.
+func (f *RemoteManager) RebuildKeyIndex(ctx context.Context) (int, error) {
+	const batchSize = 1024
+
+	qr, err := f.index.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	stale, err := qr.Rest()
+	qr.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	batch, err := f.index.Batch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range stale {
+		if err := batch.Delete(ctx, ds.RawKey(e.Key)); err != nil {
+			return 0, err
+		}
+		if (i+1)%batchSize == 0 {
+			if err := batch.Commit(ctx); err != nil {
+				return 0, err
+			}
+			if batch, err = f.index.Batch(ctx); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	if batch, err = f.index.Batch(ctx); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	put := func(m mh.Multihash, dobj *pb.DataObj) error {
+		if err := f.indexPut(ctx, batch, m, dobj); err != nil {
+			return err
+		}
+
+		count++
+		if count%batchSize == 0 {
+			if err := batch.Commit(ctx); err != nil {
+				return err
+			}
+			if batch, err = f.index.Batch(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	qr, err = f.ds.Query(ctx, dsq.Query{})
+	if err != nil {
+		return 0, err
+	}
+	defer qr.Close()
+
+	for {
+		m, dobj, err := next(qr)
+		if dobj == nil && err == nil {
+			break
+		}
+		if err != nil {
+			logger.Errorf("skipping reference while rebuilding index: %s", err)
+			continue
+		}
+		if err := put(m, dobj); err != nil {
+			return count, err
+		}
+	}
+
+	lr, err := f.locations.Query(ctx, dsq.Query{})
+	if err != nil {
+		return count, err
+	}
+	defer lr.Close()
+
+	for {
+		r, ok := lr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return count, r.Error
+		}
+
+		m, err := dshelp.DsKeyToMultihash(ds.NewKey(ds.RawKey(r.Key).List()[0]))
+		if err != nil {
+			logger.Errorf("skipping location while rebuilding index: %s", err)
+			continue
+		}
+		dobj, err := unmarshalDataObj(r.Value)
+		if err != nil {
+			logger.Errorf("skipping location while rebuilding index: %s", err)
+			continue
+		}
+		if err := put(m, dobj); err != nil {
+			return count, err
+		}
+	}
+
+	return count, batch.Commit(ctx)
+}
@@ -2,10 +2,103 @@ package remotestore
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
 )
 
+// ErrNotSupported is returned by optional source methods the underlying
+// source is unable to serve.
+var ErrNotSupported = errors.New("operation not supported by source")
+
 type RemoteSource interface {
 	Get(ctx context.Context, key string) (io.ReadCloser, uint64, error)
 	GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error)
 }
+
+// ViewSource is implemented by sources which can expose a part of an object
+// in memory without copying it, e.g. from a memory mapping. The slice passed
+// to fn is only valid during the call. ViewPart returns ErrNotSupported when
+// the part can't be viewed, so that it is read with GetPart instead.
+type ViewSource interface {
+	RemoteSource
+	ViewPart(ctx context.Context, key string, offset uint64, size uint64, fn func([]byte) error) error
+}
+
+// KeyNormalizer is implemented by sources accepting several keys for the
+// same object. NormalizeKey returns the canonical key, which is the one
+// stored in references.
+type KeyNormalizer interface {
+	NormalizeKey(key string) (string, error)
+}
+
+// StatSource is implemented by sources which can describe an object without
+// reading it. Stat returns a CorruptReferenceError with StatusFileNotFound
+// when the object does not exist.
+type StatSource interface {
+	RemoteSource
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+}
+
+// ListSource is implemented by sources which can list their objects.
+type ListSource interface {
+	RemoteSource
+	// List calls fn with the key of every object whose key starts with
+	// prefix, stopping at the first error fn returns. The key hierarchy
+	// is separated by slashes.
+	List(ctx context.Context, prefix string, fn func(key string) error) error
+}
+
+// ObjectInfo is the fingerprint of a remote object, recorded when the object
+// is indexed and compared later on to detect changes without reading it.
+type ObjectInfo struct {
+	Size uint64 `json:"size"`
+	// ETag is the entity tag of the object, if the source has one.
+	ETag string `json:"etag,omitempty"`
+	// VersionID is the version of the object, if the source keeps them.
+	VersionID string `json:"version_id,omitempty"`
+	// Checksum is a content checksum prefixed by its algorithm,
+	// e.g. `sha256:<base64>`.
+	Checksum string    `json:"checksum,omitempty"`
+	ModTime  time.Time `json:"mtime"`
+	// Inode and Device identify a local file, a file replaced by another
+	// one has a different identity.
+	Inode  uint64 `json:"inode,omitempty"`
+	Device uint64 `json:"device,omitempty"`
+
+	// Root is the root of the DAG built when the object was indexed. It
+	// is not part of the fingerprint.
+	Root cid.Cid `json:"root"`
+}
+
+// HasFingerprint reports whether the info carries anything besides the size
+// which can tell two versions of an object apart.
+func (o *ObjectInfo) HasFingerprint() bool {
+	return o.ETag != "" || o.VersionID != "" || o.Checksum != "" || !o.ModTime.IsZero() || o.Inode != 0
+}
+
+// Matches reports whether o and other describe the same version of an
+// object. Only the fields set on both sides are compared.
+func (o *ObjectInfo) Matches(other *ObjectInfo) bool {
+	if o.Size != other.Size {
+		return false
+	}
+	if o.ETag != "" && other.ETag != "" && o.ETag != other.ETag {
+		return false
+	}
+	if o.VersionID != "" && other.VersionID != "" && o.VersionID != other.VersionID {
+		return false
+	}
+	if o.Checksum != "" && other.Checksum != "" && o.Checksum != other.Checksum {
+		return false
+	}
+	if !o.ModTime.IsZero() && !other.ModTime.IsZero() && !o.ModTime.Equal(other.ModTime) {
+		return false
+	}
+	if o.Inode != 0 && other.Inode != 0 && (o.Inode != other.Inode || o.Device != other.Device) {
+		return false
+	}
+	return true
+}
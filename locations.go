@@ -0,0 +1,221 @@
+package remotestore
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	pb "github.com/ipfs/boxo/filestore/pb"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	mh "github.com/multiformats/go-multihash"
+	proto "google.golang.org/protobuf/proto"
+)
+
+// Location is a part of a key holding the data of a block.
+type Location struct {
+	Key    string
+	Offset uint64
+	Size   uint64
+}
+
+// locationKey returns the key of the alternative location of the block m
+// in path.
+func locationKey(m mh.Multihash, path string) ds.Key {
+	return dshelp.MultihashToDsKey(m).Child(objectKey(path))
+}
+
+// alternates returns the alternative locations of the block m, ordered by
+// key.
+func (f *RemoteManager) alternates(ctx context.Context, m mh.Multihash) ([]*pb.DataObj, error) {
+	qr, err := f.locations.Query(ctx, dsq.Query{Prefix: dshelp.MultihashToDsKey(m).String()})
+	if err != nil {
+		return nil, err
+	}
+	defer qr.Close()
+
+	var out []*pb.DataObj
+	for {
+		r, ok := qr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+
+		dobj, err := unmarshalDataObj(r.Value)
+		if err != nil {
+			logger.Errorf("decoding location %s: %s", r.Key, err)
+			continue
+		}
+		out = append(out, dobj)
+	}
+
+	slices.SortFunc(out, func(a, b *pb.DataObj) int {
+		return strings.Compare(a.GetFilePath(), b.GetFilePath())
+	})
+	return out, nil
+}
+
+// Locations returns the locations of the block c, the one it is read from
+// first, then the ones tried in turn when that fails.
+func (f *RemoteManager) Locations(ctx context.Context, c cid.Cid) ([]Location, error) {
+	dobj, err := f.getDataObj(ctx, c.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	alts, err := f.alternates(ctx, c.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Location, 0, len(alts)+1)
+	for _, d := range append([]*pb.DataObj{dobj}, alts...) {
+		out = append(out, Location{
+			Key:    d.GetFilePath(),
+			Offset: d.GetOffset(),
+			Size:   d.GetSize(),
+		})
+	}
+	return out, nil
+}
+
+// RemoveLocation removes the location of the block c in key, leaving its
+// other locations in place. The block is only gone once it has none left.
+// It returns ErrNotFound if the block has no location in key.
+func (f *RemoteManager) RemoveLocation(ctx context.Context, c cid.Cid, key string) error {
+	key, err := f.NormalizeKey(key)
+	if err != nil {
+		return err
+	}
+
+	removed, err := f.removeLocation(ctx, c.Hash(), filepath.ToSlash(key))
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return ipld.ErrNotFound{Cid: c}
+	}
+	return nil
+}
+
+// removeLocation removes the location of the block m in path along with its
+// index entry. An alternative location takes the place of a removed
+// reference. It reports whether there was such a location.
+func (f *RemoteManager) removeLocation(ctx context.Context, m mh.Multihash, path string) (bool, error) {
+	f.writeMu.RLock()
+	defer f.writeMu.RUnlock()
+
+	dobj, err := f.getDataObj(ctx, m)
+	if ipld.IsNotFound(err) {
+		return false, f.index.Delete(ctx, indexKey(path, m))
+	} else if err != nil {
+		return false, err
+	}
+
+	if dobj.GetFilePath() == path {
+		alts, err := f.alternates(ctx, m)
+		if err != nil {
+			return false, err
+		}
+
+		if len(alts) == 0 {
+			err = f.ds.Delete(ctx, dshelp.MultihashToDsKey(m))
+		} else {
+			err = f.promote(ctx, m, alts[0])
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, f.index.Delete(ctx, indexKey(path, m))
+	}
+
+	has, err := f.locations.Has(ctx, locationKey(m, path))
+	if err != nil {
+		return false, err
+	}
+	if has {
+		if err := f.locations.Delete(ctx, locationKey(m, path)); err != nil {
+			return false, err
+		}
+	}
+
+	return has, f.index.Delete(ctx, indexKey(path, m))
+}
+
+// moveLocation points the location of the block m in from at to instead.
+// It reports whether there was such a location.
+func (f *RemoteManager) moveLocation(ctx context.Context, m mh.Multihash, from, to string) (bool, error) {
+	f.writeMu.RLock()
+	defer f.writeMu.RUnlock()
+
+	dobj, err := f.getDataObj(ctx, m)
+	if ipld.IsNotFound(err) {
+		return false, f.index.Delete(ctx, indexKey(from, m))
+	} else if err != nil {
+		return false, err
+	}
+
+	var moved *pb.DataObj
+	if dobj.GetFilePath() == from {
+		moved = dobj
+	} else {
+		data, err := f.locations.Get(ctx, locationKey(m, from))
+		if err == ds.ErrNotFound {
+			return false, f.index.Delete(ctx, indexKey(from, m))
+		} else if err != nil {
+			return false, err
+		}
+		if moved, err = unmarshalDataObj(data); err != nil {
+			return false, err
+		}
+	}
+	moved.FilePath = &to
+
+	data, err := proto.Marshal(moved)
+	if err != nil {
+		return false, err
+	}
+	if err := f.indexPut(ctx, f.index, m, moved); err != nil {
+		return false, err
+	}
+
+	switch {
+	case moved == dobj:
+		// the alternative location in to, if any, is now the reference
+		err = f.ds.Put(ctx, dshelp.MultihashToDsKey(m), data)
+		if err == nil {
+			err = f.locations.Delete(ctx, locationKey(m, to))
+		}
+	case dobj.GetFilePath() == to:
+		err = f.locations.Delete(ctx, locationKey(m, from))
+	default:
+		err = f.locations.Put(ctx, locationKey(m, to), data)
+		if err == nil {
+			err = f.locations.Delete(ctx, locationKey(m, from))
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, f.index.Delete(ctx, indexKey(from, m))
+}
+
+// promote makes the alternative location d of the block m its reference.
+func (f *RemoteManager) promote(ctx context.Context, m mh.Multihash, d *pb.DataObj) error {
+	data, err := proto.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := f.ds.Put(ctx, dshelp.MultihashToDsKey(m), data); err != nil {
+		return err
+	}
+	return f.locations.Delete(ctx, locationKey(m, d.GetFilePath()))
+}
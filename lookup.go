@@ -0,0 +1,183 @@
+package remotestore
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	bbloom "github.com/ipfs/bbloom"
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// WithBloomFilter makes the Remotestore answer most lookups of blocks it
+// doesn't have from a bloom filter of the blocks of both stores, sized for
+// entries blocks with a rate of false positives fpRate. The filter is built
+// in the background, lookups go to the stores until it is ready, and Close
+// stops the build. It learns of the blocks put through the Remotestore and
+// its RemoteManagers, the blocks written to their datastores any other way,
+// e.g. by another RemoteManager of the same namespace, are missing until
+// RebuildBloom. Since blocks can't be removed from the filter, call
+// RebuildBloom after deleting many blocks.
+func WithBloomFilter(entries int, fpRate float64) Option {
+	return func(f *Remotestore) {
+		f.bloom = &bloomFilter{entries: entries, fpRate: fpRate}
+	}
+}
+
+// WithNegativeCache makes the Remotestore remember up to size blocks found
+// in neither store. Like WithBloomFilter, it only learns of the blocks put
+// through the Remotestore and its RemoteManagers, the other ones may be
+// reported missing until they leave the cache.
+func WithNegativeCache(size int) Option {
+	return func(f *Remotestore) {
+		f.negative = ARCCache(int64(size)).(*arcCache)
+	}
+}
+
+// watchers are the functions a RemoteManager calls with the blocks it
+// wrote, so that the lookups of the Remotestores using it learn of the
+// blocks which didn't go through them.
+type watchers struct {
+	mu   sync.RWMutex
+	next int
+	fns  map[int]func(mh.Multihash)
+}
+
+// watch makes the manager call fn with every block it writes, until the
+// returned function is called.
+func (f *RemoteManager) watch(fn func(mh.Multihash)) func() {
+	w := &f.watchers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.fns == nil {
+		w.fns = make(map[int]func(mh.Multihash))
+	}
+	id := w.next
+	w.next++
+	w.fns[id] = fn
+
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.fns, id)
+	}
+}
+
+// written tells the watchers about the blocks ms, once they are committed.
+func (f *RemoteManager) written(ms ...mh.Multihash) {
+	w := &f.watchers
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	for _, fn := range w.fns {
+		for _, m := range ms {
+			fn(m)
+		}
+	}
+}
+
+type bloomFilter struct {
+	entries int
+	fpRate  float64
+
+	// active answers lookups once built, building receives the blocks put
+	// during a build.
+	active   atomic.Pointer[bbloom.Bloom]
+	building atomic.Pointer[bbloom.Bloom]
+	mu       sync.Mutex
+}
+
+func (b *bloomFilter) add(m mh.Multihash) {
+	if a := b.active.Load(); a != nil {
+		a.AddTS(m)
+	}
+	if n := b.building.Load(); n != nil {
+		n.AddTS(m)
+	}
+}
+
+// RebuildBloom rebuilds the bloom filter from the blocks of both stores,
+// dropping the deleted ones, and picking up the blocks written without the
+// Remotestore knowing. It does nothing without WithBloomFilter.
+func (f *Remotestore) RebuildBloom(ctx context.Context) error {
+	b := f.bloom
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	filter, err := bbloom.New(float64(b.entries), b.fpRate)
+	if err != nil {
+		return err
+	}
+	b.building.Store(filter)
+	defer b.building.Store(nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch, err := f.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case c, ok := <-ch:
+			if !ok {
+				b.active.Store(filter)
+				return nil
+			}
+			filter.AddTS(c.Hash())
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// missing reports whether c is known to be in neither store.
+func (f *Remotestore) missing(c cid.Cid) bool {
+	if f.bloom != nil {
+		if a := f.bloom.active.Load(); a != nil && !a.HasTS(c.Hash()) {
+			return true
+		}
+	}
+	return f.negative != nil && f.negative.contains(negativeKey(c))
+}
+
+// missed records that c is in neither store.
+func (f *Remotestore) missed(c cid.Cid) {
+	if f.negative != nil {
+		f.negative.Admit(negativeKey(c), 1)
+	}
+}
+
+// added records that the block m was put in a store.
+func (f *Remotestore) added(m mh.Multihash) {
+	if f.bloom != nil {
+		f.bloom.add(m)
+	}
+	if f.negative != nil {
+		f.negative.Forget(cid.NewCidV1(cid.Raw, m))
+	}
+}
+
+// watchManagers makes the managers report the blocks they write, if the
+// Remotestore remembers lookups.
+func (f *Remotestore) watchManagers() {
+	if f.bloom == nil && f.negative == nil {
+		return
+	}
+	for _, fm := range f.managers {
+		f.unwatch = append(f.unwatch, fm.watch(f.added))
+	}
+}
+
+// negativeKey returns the key of c in the negative cache, shared by the
+// Cids of the same multihash like the stores.
+func negativeKey(c cid.Cid) cid.Cid {
+	return cid.NewCidV1(cid.Raw, c.Hash())
+}
@@ -0,0 +1,496 @@
+package remotestore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ManifestVersion is the version of the manifests written by
+// ExportManifest, the only one ImportManifest reads.
+const ManifestVersion = 1
+
+// ErrManifestVersion is returned by ImportManifest for a manifest of
+// another version.
+var ErrManifestVersion = errors.New("unsupported manifest version")
+
+// A manifest is a stream of JSON lines, a header holding the version, then
+// the references and the recorded objects, each followed by the blocks of
+// its DAG which are not references, i.e. its intermediate nodes. The
+// primary location of a block comes before its alternative locations.
+type manifestLine struct {
+	Version int             `json:"version,omitempty"`
+	Ref     *manifestRef    `json:"ref,omitempty"`
+	Object  *manifestObject `json:"object,omitempty"`
+	Block   *manifestBlock  `json:"block,omitempty"`
+}
+
+type manifestRef struct {
+	Hash   string `json:"hash"`
+	Path   string `json:"path"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+
+	// the times are in Unix nanoseconds
+	ETag      string `json:"etag,omitempty"`
+	VersionID string `json:"version_id,omitempty"`
+	ModTime   int64  `json:"mtime,omitempty"`
+	SourceID  string `json:"source_id,omitempty"`
+	Created   int64  `json:"created,omitempty"`
+}
+
+type manifestObject struct {
+	Path string      `json:"path"`
+	Info *ObjectInfo `json:"info"`
+}
+
+type manifestBlock struct {
+	Cid  string `json:"cid"`
+	Data []byte `json:"data"`
+}
+
+// ImportOptions tunes ImportManifest.
+type ImportOptions struct {
+	// Rewrite maps the keys of the manifest to the keys of the source,
+	// e.g. to move the references to another bucket. The references and
+	// objects it maps to the empty string are skipped.
+	Rewrite func(key string) string
+}
+
+// ExportManifest writes all the references of the RemoteManager, with the
+// fingerprints and roots recorded for their objects and the nodes of their
+// DAGs held by the main blockstore, as a manifest to w. It returns the
+// number of exported references.
+func (f *Remotestore) ExportManifest(ctx context.Context, w io.Writer) (int, error) {
+	fm := f.fm
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	if err := enc.Encode(manifestLine{Version: ManifestVersion}); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	writeRef := func(m mh.Multihash, rec *Record) error {
+		count++
+		return enc.Encode(manifestLine{Ref: &manifestRef{
+			Hash:      m.B58String(),
+			Path:      rec.Path,
+			Offset:    rec.Offset,
+			Size:      rec.Size,
+			ETag:      rec.ETag,
+			VersionID: rec.VersionID,
+			ModTime:   unixNano(rec.ModTime),
+			SourceID:  rec.SourceID,
+			Created:   unixNano(rec.Created),
+		}})
+	}
+
+	qr, err := fm.ds.Query(ctx, dsq.Query{})
+	if err != nil {
+		return 0, err
+	}
+	defer qr.Close()
+
+	for {
+		r, ok := qr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return count, r.Error
+		}
+
+		m, err := dshelp.DsKeyToMultihash(ds.RawKey(r.Key))
+		if err != nil {
+			logger.Errorf("skipping reference while exporting: %s", err)
+			continue
+		}
+		rec, err := unmarshalRecord(r.Value)
+		if err != nil {
+			logger.Errorf("skipping reference while exporting: %s", err)
+			continue
+		}
+		if err := writeRef(m, rec); err != nil {
+			return count, err
+		}
+	}
+
+	lr, err := fm.locations.Query(ctx, dsq.Query{})
+	if err != nil {
+		return count, err
+	}
+	defer lr.Close()
+
+	for {
+		r, ok := lr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return count, r.Error
+		}
+
+		m, err := dshelp.DsKeyToMultihash(ds.NewKey(ds.RawKey(r.Key).List()[0]))
+		if err != nil {
+			logger.Errorf("skipping location while exporting: %s", err)
+			continue
+		}
+		rec, err := unmarshalRecord(r.Value)
+		if err != nil {
+			logger.Errorf("skipping location while exporting: %s", err)
+			continue
+		}
+		if err := writeRef(m, rec); err != nil {
+			return count, err
+		}
+	}
+
+	or, err := fm.objects.Query(ctx, dsq.Query{})
+	if err != nil {
+		return count, err
+	}
+	defer or.Close()
+
+	seen := cid.NewSet()
+	for {
+		r, ok := or.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return count, r.Error
+		}
+
+		path, err := dshelp.BinaryFromDsKey(ds.RawKey(r.Key))
+		if err != nil {
+			logger.Errorf("skipping object while exporting: %s", err)
+			continue
+		}
+		var info ObjectInfo
+		if err := json.Unmarshal(r.Value, &info); err != nil {
+			logger.Errorf("skipping object %s while exporting: %s", path, err)
+			continue
+		}
+		if err := enc.Encode(manifestLine{Object: &manifestObject{Path: string(path), Info: &info}}); err != nil {
+			return count, err
+		}
+		if err := f.exportDag(ctx, enc, info.Root, seen); err != nil {
+			return count, fmt.Errorf("exporting the DAG of %s: %w", path, err)
+		}
+	}
+
+	return count, bw.Flush()
+}
+
+// exportDag writes the blocks of the DAG of c held by the main blockstore.
+// The leaves are references, and are skipped along with the blocks in
+// seen, which were already written.
+func (f *Remotestore) exportDag(ctx context.Context, enc *json.Encoder, c cid.Cid, seen *cid.Set) error {
+	if !c.Defined() || c.Prefix().MhType == mh.IDENTITY || !seen.Visit(c) {
+		return nil
+	}
+
+	has, err := f.fm.Has(ctx, c)
+	if err != nil || has {
+		return err
+	}
+	blk, err := f.bs.Get(ctx, c)
+	if ipld.IsNotFound(err) {
+		logger.Warnf("block %s missing while exporting", c)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := enc.Encode(manifestLine{Block: &manifestBlock{Cid: c.String(), Data: blk.RawData()}}); err != nil {
+		return err
+	}
+
+	if c.Type() != cid.DagProtobuf {
+		return nil
+	}
+	nd, err := merkledag.DecodeProtobuf(blk.RawData())
+	if err != nil {
+		return err
+	}
+	for _, l := range nd.Links() {
+		if err := f.exportDag(ctx, enc, l.Cid, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportManifest adds the references and objects of the manifest read from
+// r, as written by ExportManifest, to the RemoteManager, and the nodes of
+// their DAGs to the main blockstore. Every line is validated before it is
+// written, the referenced blocks are not read. The lines are written in
+// batches, an invalid line stops the import but keeps the batches already
+// written, importing the manifest again is harmless. The fingerprints of
+// the objects keep what describes their content, not their file on the
+// exporting node. It returns the number of imported references.
+func (f *Remotestore) ImportManifest(ctx context.Context, r io.Reader, opts ImportOptions) (int, error) {
+	const batchSize = 1024
+
+	fm := f.fm
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header manifestLine
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("reading manifest header: %w", err)
+	}
+	if header.Version != ManifestVersion {
+		return 0, fmt.Errorf("%w: %d", ErrManifestVersion, header.Version)
+	}
+
+	if err := fm.register(ctx); err != nil {
+		return 0, err
+	}
+
+	var (
+		refs, index, locations ds.Batch
+		objects                ds.Batch
+		pending                map[string]string
+		written                []mh.Multihash
+		nodes                  []blocks.Block
+	)
+	// a batch is written like in PutMany, holding off MigrateRecords
+	locked := false
+	unlock := func() {
+		if locked {
+			fm.writeMu.RUnlock()
+			locked = false
+		}
+	}
+	defer unlock()
+
+	begin := func() (err error) {
+		fm.writeMu.RLock()
+		locked = true
+		if refs, err = fm.ds.Batch(ctx); err != nil {
+			return err
+		}
+		if index, err = fm.index.Batch(ctx); err != nil {
+			return err
+		}
+		if locations, err = fm.locations.Batch(ctx); err != nil {
+			return err
+		}
+		if objects, err = fm.objects.Batch(ctx); err != nil {
+			return err
+		}
+		pending = make(map[string]string)
+		written, nodes = nil, nil
+		return nil
+	}
+	// the index is committed first, like in PutMany, and the objects once
+	// their references are
+	commit := func() error {
+		if err := index.Commit(ctx); err != nil {
+			return err
+		}
+		if err := locations.Commit(ctx); err != nil {
+			return err
+		}
+		if err := refs.Commit(ctx); err != nil {
+			return err
+		}
+		if err := objects.Commit(ctx); err != nil {
+			return err
+		}
+		unlock()
+		fm.written(written...)
+
+		if len(nodes) == 0 {
+			return nil
+		}
+		cids := blockCids(nodes)
+		unlockNodes := f.claims.lock(cids...)
+		defer unlockNodes()
+		f.claims.share(nil, cids...)
+		if err := f.bs.PutMany(ctx, nodes); err != nil {
+			return err
+		}
+		for _, b := range nodes {
+			f.added(b.Cid().Hash())
+		}
+		return nil
+	}
+
+	if err := begin(); err != nil {
+		return 0, err
+	}
+
+	count, lines := 0, 0
+	for line := 2; ; line++ {
+		var l manifestLine
+		err := dec.Decode(&l)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("manifest line %d: %w", line, err)
+		}
+
+		switch {
+		case l.Block != nil && l.Ref == nil && l.Object == nil:
+			b, err := importBlock(l.Block)
+			if err != nil {
+				return count, fmt.Errorf("manifest line %d: %w", line, err)
+			}
+			nodes = append(nodes, b)
+		case l.Ref != nil && l.Object == nil && l.Block == nil:
+			m, rec, err := fm.importRef(l.Ref, opts)
+			if err != nil {
+				return count, fmt.Errorf("manifest line %d: %w", line, err)
+			}
+			if rec == nil {
+				continue
+			}
+			if err := fm.putRef(ctx, m, rec, refWriter{refs, index, locations}, pending); err != nil {
+				return count, err
+			}
+			written = append(written, m)
+			count++
+		case l.Object != nil && l.Ref == nil && l.Block == nil:
+			path, info, err := fm.importObject(l.Object, opts)
+			if err != nil {
+				return count, fmt.Errorf("manifest line %d: %w", line, err)
+			}
+			if info == nil {
+				continue
+			}
+			data, err := json.Marshal(info)
+			if err != nil {
+				return count, err
+			}
+			if err := objects.Put(ctx, objectKey(path), data); err != nil {
+				return count, err
+			}
+		default:
+			return count, fmt.Errorf("manifest line %d: expected a reference, an object or a block", line)
+		}
+
+		lines++
+		if lines%batchSize == 0 {
+			if err := commit(); err != nil {
+				return count, err
+			}
+			if err := begin(); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, commit()
+}
+
+// importKey rewrites and normalizes a key of a manifest. It returns the
+// empty string for a skipped key.
+func (f *RemoteManager) importKey(key string, opts ImportOptions) (string, error) {
+	if key == "" {
+		return "", errors.New("missing key")
+	}
+	if opts.Rewrite != nil {
+		if key = opts.Rewrite(key); key == "" {
+			return "", nil
+		}
+	}
+
+	key, err := f.NormalizeKey(filepath.FromSlash(key))
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(key), nil
+}
+
+// importRef validates a reference of a manifest. It returns a nil record
+// for a skipped reference.
+func (f *RemoteManager) importRef(ref *manifestRef, opts ImportOptions) (mh.Multihash, *Record, error) {
+	m, err := mh.FromB58String(ref.Hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding multihash %q: %w", ref.Hash, err)
+	}
+	if ref.Size == 0 {
+		return nil, nil, fmt.Errorf("empty reference of %s", ref.Hash)
+	}
+
+	path, err := f.importKey(ref.Path, opts)
+	if err != nil || path == "" {
+		return nil, nil, err
+	}
+
+	rec := f.newRecord(path, ref.Offset, ref.Size)
+	rec.ETag = ref.ETag
+	rec.VersionID = ref.VersionID
+	if ref.ModTime != 0 {
+		rec.ModTime = time.Unix(0, ref.ModTime)
+	}
+	if ref.SourceID != "" {
+		rec.SourceID = ref.SourceID
+	}
+	if ref.Created != 0 {
+		rec.Created = time.Unix(0, ref.Created)
+	}
+	return m, rec, nil
+}
+
+// importObject validates an object of a manifest. It returns a nil info for
+// a skipped object. The identity and modification time of the object are
+// the ones of the exporting node, which its copy can't match, they are
+// dropped from the fingerprint.
+func (f *RemoteManager) importObject(obj *manifestObject, opts ImportOptions) (string, *ObjectInfo, error) {
+	if obj.Info == nil {
+		return "", nil, fmt.Errorf("missing info of object %q", obj.Path)
+	}
+
+	path, err := f.importKey(obj.Path, opts)
+	if err != nil || path == "" {
+		return "", nil, err
+	}
+
+	info := *obj.Info
+	info.Inode, info.Device = 0, 0
+	info.ModTime = time.Time{}
+	return path, &info, nil
+}
+
+// importBlock validates a block of a manifest against its Cid.
+func importBlock(b *manifestBlock) (blocks.Block, error) {
+	c, err := cid.Decode(b.Cid)
+	if err != nil {
+		return nil, fmt.Errorf("decoding cid %q: %w", b.Cid, err)
+	}
+	sum, err := c.Prefix().Sum(b.Data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("data of block %s doesn't match its hash", c)
+	}
+	return blocks.NewBlockWithCid(b.Data, c)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
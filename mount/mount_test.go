@@ -2,10 +2,15 @@ package mount_test
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	rs "github.com/Dreamacro/go-ds-remote"
 	"github.com/Dreamacro/go-ds-remote/mount"
 	ds "github.com/ipfs/go-datastore"
 	"github.com/stretchr/testify/require"
@@ -59,3 +64,248 @@ func TestSource_HasBadNoMount(t *testing.T) {
 	_, err := s.GetPart(ctx, "/foo", 0, 3)
 	require.ErrorIs(t, err, ds.ErrNotFound)
 }
+
+func TestSource_StatNotSupported(t *testing.T) {
+	ctx := context.Background()
+	s := mount.New([]mount.Mount{
+		{
+			Prefix:    ds.NewKey("/bar"),
+			Datastore: &mockSource{},
+		},
+	})
+
+	_, err := s.Stat(ctx, "/bar/baz")
+	require.ErrorIs(t, err, rs.ErrNotSupported)
+
+	_, err = s.Stat(ctx, "/foo")
+	require.ErrorIs(t, err, ds.ErrNotFound)
+}
+
+type namedSource struct {
+	mockSource
+	name string
+}
+
+func (s *namedSource) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(s.name + ":" + key)), nil
+}
+
+func readPart(t *testing.T, s *mount.Source, key string) string {
+	r, err := s.GetPart(context.Background(), key, 0, 0)
+	require.NoError(t, err)
+	defer r.Close()
+	v, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(v)
+}
+
+func TestSource_Reconfigure(t *testing.T) {
+	ctx := context.Background()
+	s := mount.New([]mount.Mount{
+		{
+			Prefix:    ds.NewKey("/"),
+			Datastore: &namedSource{name: "root"},
+		},
+	})
+
+	require.Equal(t, "root:/bar/baz", readPart(t, s, "/bar/baz"))
+
+	require.NoError(t, s.Mount(mount.Mount{Prefix: ds.NewKey("/bar"), Datastore: &namedSource{name: "bar"}}))
+	require.NoError(t, s.Mount(mount.Mount{Prefix: ds.NewKey("/bar/baz"), Datastore: &namedSource{name: "baz"}}))
+	require.ErrorIs(t, s.Mount(mount.Mount{Prefix: ds.NewKey("/bar"), Datastore: &namedSource{}}), mount.ErrMountExists)
+
+	require.Equal(t, "baz:/qux", readPart(t, s, "/bar/baz/qux"))
+	require.Equal(t, "bar:/qux", readPart(t, s, "/bar/qux"))
+	require.Equal(t, "root:/foo", readPart(t, s, "/foo"))
+
+	var prefixes []string
+	for _, m := range s.Mounts() {
+		prefixes = append(prefixes, m.Prefix.String())
+	}
+	require.Equal(t, []string{"/bar/baz", "/bar", "/"}, prefixes)
+
+	<-s.Replace(mount.Mount{Prefix: ds.NewKey("/bar"), Datastore: &namedSource{name: "bar2"}})
+	require.Equal(t, "bar2:/qux", readPart(t, s, "/bar/qux"))
+
+	_, err := s.Unmount(ds.NewKey("/bar/baz"))
+	require.NoError(t, err)
+	require.Equal(t, "bar2:/baz/qux", readPart(t, s, "/bar/baz/qux"))
+
+	_, err = s.Unmount(ds.NewKey("/bar/baz"))
+	require.ErrorIs(t, err, mount.ErrNoMount)
+
+	_, err = s.Unmount(ds.NewKey("/"))
+	require.NoError(t, err)
+	_, err = s.GetPart(ctx, "/foo", 0, 3)
+	require.ErrorIs(t, err, ds.ErrNotFound)
+}
+
+func TestSource_UnmountDrain(t *testing.T) {
+	ctx := context.Background()
+	s := mount.New([]mount.Mount{
+		{
+			Prefix:    ds.NewKey("/bar"),
+			Datastore: &mockSource{},
+		},
+	})
+
+	r, err := s.GetPart(ctx, "/bar/baz", 0, 3)
+	require.NoError(t, err)
+
+	drained, err := s.Unmount(ds.NewKey("/bar"))
+	require.NoError(t, err)
+
+	select {
+	case <-drained:
+		t.Fatal("unmount drained with a read in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, r.Close())
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("unmount did not drain")
+	}
+}
+
+func TestSource_ConcurrentReconfigure(t *testing.T) {
+	ctx := context.Background()
+	s := mount.New([]mount.Mount{
+		{
+			Prefix:    ds.NewKey("/"),
+			Datastore: &mockSource{},
+		},
+	})
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			prefix := ds.NewKey(fmt.Sprintf("/m%d", i))
+			for range 100 {
+				<-s.Replace(mount.Mount{Prefix: prefix, Datastore: &mockSource{}})
+				_, err := s.Unmount(prefix)
+				require.NoError(t, err)
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				r, err := s.GetPart(ctx, fmt.Sprintf("/m%d/foo", i), 0, 3)
+				require.NoError(t, err)
+				require.NoError(t, r.Close())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSource_Rules(t *testing.T) {
+	ctx := context.Background()
+	s := mount.New([]mount.Mount{
+		{
+			Prefix:    ds.NewKey("/data"),
+			Datastore: &namedSource{name: "data"},
+		},
+	})
+
+	_, err := s.SetRules([]mount.Rule{
+		{
+			Name:      "parquet",
+			Ext:       ".parquet",
+			Datastore: &namedSource{name: "analytics"},
+		},
+		{
+			Name:      "logs",
+			Glob:      "/data/logs/*.json",
+			Rewrite:   mount.StripPrefix(ds.NewKey("/data")),
+			Datastore: &namedSource{name: "logs"},
+		},
+		{
+			Name:      "versioned",
+			Regexp:    regexp.MustCompile(`^/v(\d+)/`),
+			Rewrite:   mount.ReplaceRegexp(regexp.MustCompile(`^/v(\d+)/(.*)$`), "/$2/$1"),
+			Datastore: &namedSource{name: "versioned"},
+		},
+		{
+			Name:      "backup",
+			Glob:      "*.bak",
+			Ext:       ".bak",
+			Datastore: &namedSource{name: "backup"},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "analytics:/data/a/b.parquet", readPart(t, s, "/data/a/b.parquet"))
+	require.Equal(t, "logs:/logs/x.json", readPart(t, s, "/data/logs/x.json"))
+	require.Equal(t, "data:/logs/a/x.json", readPart(t, s, "/data/logs/a/x.json"))
+	require.Equal(t, "versioned:/foo/3", readPart(t, s, "/v3/foo"))
+	require.Equal(t, "backup:/x/y.bak", readPart(t, s, "/x/y.bak"))
+
+	m, ok := s.Explain("/data/logs/x.json")
+	require.True(t, ok)
+	require.Equal(t, mount.RouteRule, m.Route)
+	require.Equal(t, "logs", m.Rule)
+	require.Equal(t, 1, m.Index)
+	require.Equal(t, "/logs/x.json", m.Key.String())
+
+	m, ok = s.Explain("/data/x.json")
+	require.True(t, ok)
+	require.Equal(t, mount.RouteMount, m.Route)
+	require.Equal(t, "/data", m.Rule)
+	require.Equal(t, "/x.json", m.Key.String())
+
+	_, ok = s.Explain("/other")
+	require.False(t, ok)
+	_, err = s.GetPart(ctx, "/other", 0, 0)
+	require.ErrorIs(t, err, ds.ErrNotFound)
+
+	<-s.SetFallback(&namedSource{name: "default"})
+	m, ok = s.Explain("/other")
+	require.True(t, ok)
+	require.Equal(t, mount.RouteFallback, m.Route)
+	require.Equal(t, "default:/other", readPart(t, s, "/other"))
+
+	_, err = s.SetRules([]mount.Rule{{Name: "bad", Glob: "[", Datastore: &mockSource{}}})
+	require.Error(t, err)
+	_, err = s.SetRules([]mount.Rule{{Name: "empty"}})
+	require.Error(t, err)
+
+	// failed updates keep the previous rules
+	require.Equal(t, "analytics:/data/a/b.parquet", readPart(t, s, "/data/a/b.parquet"))
+}
+
+type lowerSource struct {
+	mockSource
+}
+
+func (s *lowerSource) NormalizeKey(key string) (string, error) {
+	return strings.ToLower(strings.TrimPrefix(key, "/")), nil
+}
+
+func TestSource_NormalizeKey(t *testing.T) {
+	s := mount.New([]mount.Mount{
+		{
+			Prefix:    ds.NewKey("/lower"),
+			Datastore: &lowerSource{},
+		},
+		{
+			Prefix:    ds.NewKey("/raw"),
+			Datastore: &mockSource{},
+		},
+	})
+
+	for key, want := range map[string]string{
+		"/lower/Foo/BAR": "/lower/foo/bar",
+		"lower/Foo":      "/lower/foo",
+		"/raw/Foo":       "/raw/Foo",
+		"/other/Foo":     "/other/Foo",
+	} {
+		k, err := s.NormalizeKey(key)
+		require.NoError(t, err)
+		require.Equal(t, want, k)
+	}
+}
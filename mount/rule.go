@@ -0,0 +1,135 @@
+package mount
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Rule routes the keys it matches to a source. A key matches if it
+// satisfies every matcher set on the rule, a rule without matcher matches
+// every key.
+type Rule struct {
+	// Name identifies the rule in Explain results.
+	Name string
+
+	// Glob matches keys with path.Match, e.g. `/logs/*/*.json`. A pattern
+	// without `/` is matched against the last element of the key, so that
+	// `*.parquet` matches `/a/b/c.parquet`.
+	Glob string
+
+	// Regexp matches the string form of keys, e.g. `/a/b`.
+	Regexp *regexp.Regexp
+
+	// Ext matches keys with the given extension, including the dot.
+	Ext string
+
+	// Rewrite returns the key passed to the source. The key is passed
+	// unchanged if nil.
+	Rewrite Rewrite
+
+	Datastore rs.RemoteSource
+}
+
+// Rewrite turns the key of a read into the key passed to the source.
+type Rewrite func(key ds.Key) ds.Key
+
+// StripPrefix returns a Rewrite removing prefix from the keys, the same way
+// mounts do.
+func StripPrefix(prefix ds.Key) Rewrite {
+	return func(key ds.Key) ds.Key {
+		if !prefix.IsAncestorOf(key) {
+			return key
+		}
+		return ds.NewKey(strings.TrimPrefix(key.String(), prefix.String()))
+	}
+}
+
+// ReplaceRegexp returns a Rewrite replacing the matches of re with repl,
+// which can refer to submatches as in regexp.Regexp.ReplaceAllString.
+func ReplaceRegexp(re *regexp.Regexp, repl string) Rewrite {
+	return func(key ds.Key) ds.Key {
+		return ds.NewKey(re.ReplaceAllString(key.String(), repl))
+	}
+}
+
+func (r *Rule) validate() error {
+	if r.Datastore == nil {
+		return fmt.Errorf("rule %q has no datastore", r.Name)
+	}
+	if r.Glob != "" {
+		if _, err := path.Match(r.Glob, ""); err != nil {
+			return fmt.Errorf("rule %q has an invalid glob: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(key ds.Key) bool {
+	k := key.String()
+
+	if r.Glob != "" {
+		name := k
+		if !strings.Contains(r.Glob, "/") {
+			name = path.Base(k)
+		}
+		if ok, _ := path.Match(r.Glob, name); !ok {
+			return false
+		}
+	}
+
+	if r.Regexp != nil && !r.Regexp.MatchString(k) {
+		return false
+	}
+
+	if r.Ext != "" && path.Ext(k) != r.Ext {
+		return false
+	}
+
+	return true
+}
+
+// Route identifies the kind of route a key took.
+type Route int
+
+const (
+	RouteNone Route = iota
+	RouteRule
+	RouteMount
+	RouteFallback
+)
+
+func (r Route) String() string {
+	switch r {
+	case RouteRule:
+		return "rule"
+	case RouteMount:
+		return "mount"
+	case RouteFallback:
+		return "fallback"
+	default:
+		return "none"
+	}
+}
+
+// Match describes how a key is routed.
+type Match struct {
+	Route Route
+
+	// Rule is the name of the matching rule, or the prefix of the matching
+	// mount.
+	Rule string
+
+	// Index is the position of the matching rule or mount, in evaluation
+	// order.
+	Index int
+
+	// Key is the key passed to the source.
+	Key ds.Key
+
+	Datastore rs.RemoteSource
+}
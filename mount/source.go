@@ -2,56 +2,343 @@ package mount
 
 import (
 	"context"
+	"errors"
 	"io"
 	"slices"
 	"strings"
+	"sync"
 
 	rs "github.com/Dreamacro/go-ds-remote"
 	ds "github.com/ipfs/go-datastore"
 )
 
-var _ rs.RemoteSource = (*Source)(nil)
+var (
+	_ rs.StatSource    = (*Source)(nil)
+	_ rs.KeyNormalizer = (*Source)(nil)
+)
+
+var (
+	ErrMountExists = errors.New("mount already exists")
+	ErrNoMount     = errors.New("no mount at prefix")
+)
 
 type Mount struct {
 	Prefix    ds.Key
 	Datastore rs.RemoteSource
 }
 
+type mount struct {
+	Mount
+
+	// inflight counts the reads which looked the mount up and are not
+	// finished yet. Add is only called under the read lock of Source, so it
+	// can't race with the Wait of an unmount.
+	inflight sync.WaitGroup
+}
+
+type rule struct {
+	Rule
+	inflight sync.WaitGroup
+}
+
+type fallback struct {
+	source   rs.RemoteSource
+	inflight sync.WaitGroup
+}
+
+// Source dispatches keys to sources. The routing rules are evaluated first,
+// in order, and the first matching one wins. Keys matching no rule go to the
+// source mounted at their longest prefix, and finally to the fallback source.
+// Rules and mounts can be changed at runtime, concurrently with reads.
 type Source struct {
-	mounts []Mount
+	mu       sync.RWMutex
+	rules    []*rule
+	mounts   []*mount
+	fallback *fallback
 }
 
 func New(mounts []Mount) *Source {
-	mounts = slices.Clone(mounts)
-	slices.SortFunc(mounts, func(a, b Mount) int {
-		return strings.Compare(b.Prefix.String(), a.Prefix.String())
+	s := &Source{}
+	for _, m := range mounts {
+		s.mounts = append(s.mounts, &mount{Mount: m})
+	}
+	slices.SortFunc(s.mounts, compareMount)
+	return s
+}
+
+// compareMount orders mounts by descending prefix, so that the first
+// matching mount is the one with the longest prefix.
+func compareMount(a, b *mount) int {
+	return strings.Compare(b.Prefix.String(), a.Prefix.String())
+}
+
+func (s *Source) find(prefix ds.Key) (int, bool) {
+	return slices.BinarySearchFunc(s.mounts, prefix, func(m *mount, prefix ds.Key) int {
+		return strings.Compare(prefix.String(), m.Prefix.String())
 	})
-	return &Source{mounts: mounts}
 }
 
-func (s *Source) lookup(key ds.Key) (rs.RemoteSource, ds.Key, ds.Key) {
+// Mounts returns the current mounts, longest prefix first.
+func (s *Source) Mounts() []Mount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Mount, 0, len(s.mounts))
 	for _, m := range s.mounts {
+		out = append(out, m.Mount)
+	}
+	return out
+}
+
+// Mount adds a new mount. It returns ErrMountExists if the prefix is
+// already mounted.
+func (s *Source) Mount(m Mount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, found := s.find(m.Prefix)
+	if found {
+		return ErrMountExists
+	}
+	s.mounts = slices.Insert(s.mounts, i, &mount{Mount: m})
+	return nil
+}
+
+// Unmount removes the mount at prefix. It returns ErrNoMount if nothing is
+// mounted there. The returned channel is closed once every read in flight
+// on the removed mount is finished, i.e. all its readers are closed.
+func (s *Source) Unmount(prefix ds.Key) (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, found := s.find(prefix)
+	if !found {
+		return nil, ErrNoMount
+	}
+	old := s.mounts[i]
+	s.mounts = slices.Delete(s.mounts, i, i+1)
+	return drain(old), nil
+}
+
+// Replace mounts m in place of the mount with the same prefix, or adds it
+// if there is none. The returned channel is closed once every read in flight
+// on the replaced mount is finished.
+func (s *Source) Replace(m Mount) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, found := s.find(m.Prefix)
+	if !found {
+		s.mounts = slices.Insert(s.mounts, i, &mount{Mount: m})
+		return drain(nil)
+	}
+	old := s.mounts[i]
+	s.mounts[i] = &mount{Mount: m}
+	return drain(old)
+}
+
+func drain(m *mount) <-chan struct{} {
+	done := make(chan struct{})
+	if m == nil {
+		close(done)
+		return done
+	}
+	go func() {
+		m.inflight.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// SetRules replaces the routing rules. The returned channel is closed once
+// every read in flight on the previous rules is finished.
+func (s *Source) SetRules(rules []Rule) (<-chan struct{}, error) {
+	next := make([]*rule, 0, len(rules))
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		next = append(next, &rule{Rule: r})
+	}
+
+	s.mu.Lock()
+	prev := s.rules
+	s.rules = next
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, r := range prev {
+			r.inflight.Wait()
+		}
+		close(done)
+	}()
+	return done, nil
+}
+
+// SetFallback sets the source of the keys matching neither a rule nor a
+// mount, nil to return ds.ErrNotFound for them. The returned channel is
+// closed once every read in flight on the previous fallback is finished.
+func (s *Source) SetFallback(source rs.RemoteSource) <-chan struct{} {
+	var next *fallback
+	if source != nil {
+		next = &fallback{source: source}
+	}
+
+	s.mu.Lock()
+	prev := s.fallback
+	s.fallback = next
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		if prev != nil {
+			prev.inflight.Wait()
+		}
+		close(done)
+	}()
+	return done
+}
+
+// Explain describes how key is routed, without reading anything. It returns
+// false if no source serves the key.
+func (s *Source) Explain(key string) (Match, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, inflight := s.match(ds.NewKey(key))
+	return m, inflight != nil
+}
+
+// match routes key. It must be called with the lock held. The returned
+// inflight counter is nil if no source serves the key.
+func (s *Source) match(key ds.Key) (Match, *sync.WaitGroup) {
+	for i, r := range s.rules {
+		if r.match(key) {
+			k := key
+			if r.Rewrite != nil {
+				k = r.Rewrite(key)
+			}
+			return Match{
+				Route:     RouteRule,
+				Rule:      r.Name,
+				Index:     i,
+				Key:       k,
+				Datastore: r.Datastore,
+			}, &r.inflight
+		}
+	}
+
+	for i, m := range s.mounts {
 		if m.Prefix.IsAncestorOf(key) {
 			s := strings.TrimPrefix(key.String(), m.Prefix.String())
-			k := ds.NewKey(s)
-			return m.Datastore, m.Prefix, k
+			return Match{
+				Route:     RouteMount,
+				Rule:      m.Prefix.String(),
+				Index:     i,
+				Key:       ds.NewKey(s),
+				Datastore: m.Datastore,
+			}, &m.inflight
 		}
 	}
-	return nil, ds.NewKey("/"), key
+
+	if s.fallback != nil {
+		return Match{
+			Route:     RouteFallback,
+			Key:       key,
+			Datastore: s.fallback.source,
+		}, &s.fallback.inflight
+	}
+
+	return Match{Key: key}, nil
+}
+
+// lookup returns the source of key and the key to pass it. The caller must
+// call Done on the returned inflight counter once the read is finished.
+func (s *Source) lookup(key ds.Key) (rs.RemoteSource, ds.Key, *sync.WaitGroup) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, inflight := s.match(key)
+	if inflight == nil {
+		return nil, key, nil
+	}
+	inflight.Add(1)
+	return m.Datastore, m.Key, inflight
+}
+
+type trackedReader struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (r *trackedReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.done)
+	return err
 }
 
 func (s *Source) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
-	source, _, k := s.lookup(ds.NewKey(key))
+	source, k, inflight := s.lookup(ds.NewKey(key))
 	if source == nil {
 		return nil, ds.ErrNotFound
 	}
-	return source.GetPart(ctx, k.String(), offset, size)
+	r, err := source.GetPart(ctx, k.String(), offset, size)
+	if err != nil {
+		inflight.Done()
+		return nil, err
+	}
+	return &trackedReader{ReadCloser: r, done: inflight.Done}, nil
 }
 
 func (s *Source) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
-	source, _, k := s.lookup(ds.NewKey(key))
+	source, k, inflight := s.lookup(ds.NewKey(key))
 	if source == nil {
 		return nil, 0, ds.ErrNotFound
 	}
-	return source.Get(ctx, k.String())
+	r, size, err := source.Get(ctx, k.String())
+	if err != nil {
+		inflight.Done()
+		return nil, 0, err
+	}
+	return &trackedReader{ReadCloser: r, done: inflight.Done}, size, nil
+}
+
+func (s *Source) Stat(ctx context.Context, key string) (*rs.ObjectInfo, error) {
+	source, k, inflight := s.lookup(ds.NewKey(key))
+	if source == nil {
+		return nil, ds.ErrNotFound
+	}
+	defer inflight.Done()
+
+	ss, ok := source.(rs.StatSource)
+	if !ok {
+		return nil, rs.ErrNotSupported
+	}
+	return ss.Stat(ctx, k.String())
+}
+
+// NormalizeKey normalizes the key with the source of its mount, if it is a
+// rs.KeyNormalizer. Keys routed by rules or to the fallback are returned
+// unchanged, since a rewrite can't be reversed.
+func (s *Source) NormalizeKey(key string) (string, error) {
+	s.mu.RLock()
+	m, inflight := s.match(ds.NewKey(key))
+	s.mu.RUnlock()
+
+	if inflight == nil || m.Route != RouteMount {
+		return key, nil
+	}
+
+	kn, ok := m.Datastore.(rs.KeyNormalizer)
+	if !ok {
+		return key, nil
+	}
+
+	k, err := kn.NormalizeKey(m.Key.String())
+	if err != nil {
+		return "", err
+	}
+	return ds.NewKey(m.Rule).Child(ds.NewKey(k)).String(), nil
 }
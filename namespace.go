@@ -0,0 +1,213 @@
+package remotestore
+
+import (
+	"context"
+	"slices"
+
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// RemotestoreNamespacePrefix identifies the key prefix under which the keys
+// of a named namespace are stored. The default namespace is stored at the
+// root of the datastore.
+var RemotestoreNamespacePrefix = ds.NewKey("remotestore-ns")
+
+// RemotestoreNamespacesPrefix identifies the key prefix for the names of
+// the namespaces which were written to.
+var RemotestoreNamespacesPrefix = ds.NewKey("remotestore-namespaces")
+
+// WithNamespace isolates the references of the RemoteManager, and
+// everything recorded along with them, in the namespace name of the
+// datastore. Managers of different namespaces share nothing. Any name is
+// valid, the empty one being the default namespace.
+func WithNamespace(name string) ManagerOption {
+	return func(f *RemoteManager) {
+		f.namespace = name
+	}
+}
+
+// namespaceKey returns the key of the namespace name, which may hold any
+// character.
+func namespaceKey(name string) ds.Key {
+	return dshelp.NewKeyFromBinary([]byte(name))
+}
+
+// Namespace returns the namespace of the RemoteManager, which is empty for
+// the default one.
+func (f *RemoteManager) Namespace() string {
+	return f.namespace
+}
+
+// register records the namespace of the manager once it holds references.
+func (f *RemoteManager) register(ctx context.Context) error {
+	if f.namespace == "" || f.registered.Load() {
+		return nil
+	}
+	if err := f.root.Put(ctx, RemotestoreNamespacesPrefix.Child(namespaceKey(f.namespace)), nil); err != nil {
+		return err
+	}
+	f.registered.Store(true)
+	return nil
+}
+
+// Namespaces returns the namespaces of d holding references, sorted, the
+// default one being the empty string.
+func Namespaces(ctx context.Context, d ds.Datastore) ([]string, error) {
+	var names []string
+
+	has, err := hasReferences(ctx, d, RemotestorePrefix)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		names = append(names, "")
+	}
+
+	qr, err := d.Query(ctx, dsq.Query{Prefix: RemotestoreNamespacesPrefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	written, err := qr.Rest()
+	qr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// the namespaces are registered once written to, and stay registered
+	// once their references are gone
+	for _, r := range written {
+		key := ds.NewKey(ds.RawKey(r.Key).BaseNamespace())
+		name, err := dshelp.BinaryFromDsKey(key)
+		if err != nil {
+			logger.Errorf("skipping namespace %s: %s", key, err)
+			continue
+		}
+
+		has, err := hasReferences(ctx, d, RemotestoreNamespacePrefix.Child(key).Child(RemotestorePrefix))
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			names = append(names, string(name))
+		}
+	}
+
+	slices.Sort(names)
+	return names, nil
+}
+
+// hasReferences reports whether d holds a key under prefix.
+func hasReferences(ctx context.Context, d ds.Datastore, prefix ds.Key) (bool, error) {
+	qr, err := d.Query(ctx, dsq.Query{Prefix: prefix.String(), KeysOnly: true, Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	rest, err := qr.Rest()
+	qr.Close()
+	return len(rest) > 0, err
+}
+
+type prioritizedManager struct {
+	fm       *RemoteManager
+	priority int
+}
+
+// WithManager makes the Remotestore also serve the references of fm, e.g.
+// of another namespace with its own source. Blocks are looked up in the
+// managers by decreasing priority, the RemoteManager of the Remotestore
+// having priority 0 and coming first among equals. New references are
+// always written to the RemoteManager of the Remotestore.
+func WithManager(fm *RemoteManager, priority int) Option {
+	return func(f *Remotestore) {
+		f.extra = append(f.extra, prioritizedManager{fm, priority})
+	}
+}
+
+// orderManagers sets the lookup order of the managers of the Remotestore.
+func (f *Remotestore) orderManagers() {
+	all := append([]prioritizedManager{{f.fm, 0}}, f.extra...)
+	slices.SortStableFunc(all, func(a, b prioritizedManager) int {
+		return b.priority - a.priority
+	})
+
+	f.managers = make([]*RemoteManager, len(all))
+	for i, m := range all {
+		f.managers[i] = m.fm
+	}
+}
+
+// Managers returns the managers serving the references of the Remotestore,
+// in lookup order.
+func (f *Remotestore) Managers() []*RemoteManager {
+	return slices.Clone(f.managers)
+}
+
+// remoteHas reports whether a manager references c.
+func (f *Remotestore) remoteHas(ctx context.Context, c cid.Cid) (bool, error) {
+	for _, fm := range f.managers {
+		has, err := fm.Has(ctx, c)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+// remoteGetSize returns the size of c in the first manager referencing it.
+func (f *Remotestore) remoteGetSize(ctx context.Context, c cid.Cid) (int, error) {
+	for _, fm := range f.managers {
+		size, err := fm.GetSize(ctx, c)
+		if !ipld.IsNotFound(err) {
+			return size, err
+		}
+	}
+	return -1, ipld.ErrNotFound{Cid: c}
+}
+
+// remoteGet reads c from the first manager able to serve it. The error of
+// the first manager referencing c is returned if none is.
+func (f *Remotestore) remoteGet(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	var firstErr error
+	for _, fm := range f.managers {
+		blk, err := fm.get(ctx, c)
+		if err == nil {
+			return blk, nil
+		}
+		if firstErr == nil && !ipld.IsNotFound(err) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+// remoteView is like remoteGet, but calls fn with the data of c like View.
+func (f *Remotestore) remoteView(ctx context.Context, c cid.Cid, fn func([]byte) error) error {
+	called := false
+	view := func(data []byte) error {
+		called = true
+		return fn(data)
+	}
+
+	var firstErr error
+	for _, fm := range f.managers {
+		err := fm.View(ctx, c, view)
+		if err == nil || called {
+			return err
+		}
+		if firstErr == nil && !ipld.IsNotFound(err) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return ipld.ErrNotFound{Cid: c}
+}
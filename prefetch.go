@@ -0,0 +1,346 @@
+package remotestore
+
+import (
+	linked "container/list"
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	pb "github.com/ipfs/boxo/filestore/pb"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	// prefetchWorkers bounds the concurrent prefetches of a Remotestore,
+	// the ones beyond are dropped.
+	prefetchWorkers = 4
+
+	// prefetchTracked bounds the number of blocks whose position among
+	// the links of their parent is remembered.
+	prefetchTracked = 1 << 16
+)
+
+// PrefetchStats reports the activity of the prefetcher of a Remotestore.
+type PrefetchStats struct {
+	// Hits counts the blocks served from the prefetch buffer.
+	Hits uint64
+	// Fetched counts the prefetched blocks, and Reads the ranged reads
+	// they were coalesced into.
+	Fetched uint64
+	Reads   uint64
+	// Dropped counts the prefetched blocks evicted from the buffer before
+	// they were read.
+	Dropped uint64
+}
+
+// WithPrefetch makes the Remotestore prefetch the next depth children of a
+// dag-pb node when it or one of its children is read, keeping up to limit
+// bytes of prefetched blocks in memory, so fewer children are prefetched
+// when depth of them don't fit. Children stored next to each other in the
+// same object are read with a single ranged read. Close cancels the running
+// prefetches.
+func WithPrefetch(depth int, limit int64) Option {
+	return func(f *Remotestore) {
+		f.prefetch = newPrefetcher(depth, limit)
+	}
+}
+
+// PrefetchStats returns the activity of the prefetcher, which is zero
+// without WithPrefetch.
+func (f *Remotestore) PrefetchStats() PrefetchStats {
+	if f.prefetch == nil {
+		return PrefetchStats{}
+	}
+	return f.prefetch.stats()
+}
+
+// siblings is the position of a block among the links of its parent.
+type siblings struct {
+	links []cid.Cid
+	index int
+}
+
+type prefetched struct {
+	c    cid.Cid
+	data []byte
+}
+
+type prefetcher struct {
+	// managers are the managers of the Remotestore, in lookup order.
+	managers []*RemoteManager
+	depth    int
+	limit    int64
+	sem      chan struct{}
+
+	// ctx is cancelled by Close, which waits for the workers in wg.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	used      int64
+	order     *linked.List
+	buffered  map[cid.Cid]*linked.Element
+	inflight  map[cid.Cid]struct{}
+	positions *simplelru.LRU[cid.Cid, siblings]
+
+	hits, fetched, reads, dropped atomic.Uint64
+}
+
+func newPrefetcher(depth int, limit int64) *prefetcher {
+	positions, _ := simplelru.NewLRU[cid.Cid, siblings](prefetchTracked, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &prefetcher{
+		depth:     depth,
+		limit:     limit,
+		sem:       make(chan struct{}, prefetchWorkers),
+		ctx:       ctx,
+		cancel:    cancel,
+		order:     linked.New(),
+		buffered:  make(map[cid.Cid]*linked.Element),
+		inflight:  make(map[cid.Cid]struct{}),
+		positions: positions,
+	}
+}
+
+func (p *prefetcher) stats() PrefetchStats {
+	return PrefetchStats{
+		Hits:    p.hits.Load(),
+		Fetched: p.fetched.Load(),
+		Reads:   p.reads.Load(),
+		Dropped: p.dropped.Load(),
+	}
+}
+
+// node records the children of the block c, if it is a dag-pb node, and
+// prefetches the first ones.
+func (p *prefetcher) node(c cid.Cid, data []byte) {
+	if p == nil || c.Type() != cid.DagProtobuf {
+		return
+	}
+
+	nd, err := merkledag.DecodeProtobuf(data)
+	if err != nil || len(nd.Links()) == 0 {
+		return
+	}
+
+	links := make([]cid.Cid, len(nd.Links()))
+	for i, l := range nd.Links() {
+		links[i] = l.Cid
+	}
+
+	p.mu.Lock()
+	for i, l := range links {
+		p.positions.Add(l, siblings{links: links, index: i})
+	}
+	p.mu.Unlock()
+
+	p.fetch(links[:min(len(links), p.depth)])
+}
+
+// take returns the prefetched data of c, and prefetches its next siblings.
+func (p *prefetcher) take(c cid.Cid) ([]byte, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	p.mu.Lock()
+	var data []byte
+	e, ok := p.buffered[c]
+	if ok {
+		data = p.remove(e)
+	}
+	pos, known := p.positions.Get(c)
+	p.mu.Unlock()
+
+	if ok {
+		p.hits.Add(1)
+	}
+	if known {
+		next := pos.links[pos.index+1:]
+		p.fetch(next[:min(len(next), p.depth)])
+	}
+	return data, ok
+}
+
+func (p *prefetcher) remove(e *linked.Element) []byte {
+	b := p.order.Remove(e).(*prefetched)
+	delete(p.buffered, b.c)
+	p.used -= int64(len(b.data))
+	return b.data
+}
+
+// fetch reads the blocks of cids which are neither buffered nor being read
+// in the background.
+func (p *prefetcher) fetch(cids []cid.Cid) {
+	p.mu.Lock()
+	var todo []cid.Cid
+	for _, c := range cids {
+		if _, ok := p.buffered[c]; ok {
+			continue
+		}
+		if _, ok := p.inflight[c]; ok {
+			continue
+		}
+		p.inflight[c] = struct{}{}
+		todo = append(todo, c)
+	}
+	p.mu.Unlock()
+
+	if len(todo) == 0 {
+		return
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		p.done(todo)
+		return
+	}
+
+	p.mu.Lock()
+	if p.ctx.Err() != nil {
+		p.mu.Unlock()
+		<-p.sem
+		p.done(todo)
+		return
+	}
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+		defer p.done(todo)
+
+		p.read(p.ctx, todo)
+	}()
+}
+
+// close cancels the running prefetches and waits for them to stop. No
+// prefetch starts afterwards.
+func (p *prefetcher) close() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.cancel()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *prefetcher) done(cids []cid.Cid) {
+	p.mu.Lock()
+	for _, c := range cids {
+		delete(p.inflight, c)
+	}
+	p.mu.Unlock()
+}
+
+type prefetchRef struct {
+	c    cid.Cid
+	fm   *RemoteManager
+	dobj *pb.DataObj
+}
+
+// read reads the references among cids, coalescing the ones stored one
+// after the other in the same object of the same manager. It stops at the
+// first one which doesn't fit in the room left in the buffer, it would only
+// push out blocks not read yet.
+func (p *prefetcher) read(ctx context.Context, cids []cid.Cid) {
+	p.mu.Lock()
+	budget := p.limit - p.used
+	p.mu.Unlock()
+
+	var run []prefetchRef
+	for _, c := range cids {
+		if ctx.Err() != nil {
+			return
+		}
+
+		ref, ok := p.lookup(ctx, c)
+		if !ok {
+			// not a reference
+			continue
+		}
+		if budget -= int64(ref.dobj.GetSize()); budget < 0 {
+			break
+		}
+
+		if n := len(run); n > 0 {
+			last := run[n-1]
+			if last.fm != ref.fm || last.dobj.GetFilePath() != ref.dobj.GetFilePath() || last.dobj.GetOffset()+last.dobj.GetSize() != ref.dobj.GetOffset() {
+				p.readRun(ctx, run)
+				run = nil
+			}
+		}
+		run = append(run, ref)
+	}
+	if len(run) > 0 {
+		p.readRun(ctx, run)
+	}
+}
+
+// lookup returns the reference of c in the first manager holding one.
+func (p *prefetcher) lookup(ctx context.Context, c cid.Cid) (prefetchRef, bool) {
+	for _, fm := range p.managers {
+		dobj, err := fm.getDataObj(ctx, c.Hash())
+		if err == nil {
+			return prefetchRef{c, fm, dobj}, true
+		}
+	}
+	return prefetchRef{}, false
+}
+
+func (p *prefetcher) readRun(ctx context.Context, run []prefetchRef) {
+	first, last := run[0].dobj, run[len(run)-1].dobj
+	offset := first.GetOffset()
+	size := last.GetOffset() + last.GetSize() - offset
+	reader, err := run[0].fm.source.GetPart(ctx, filepath.FromSlash(first.GetFilePath()), offset, size)
+	if err != nil {
+		logger.Debugf("prefetching %s: %s", first.GetFilePath(), err)
+		return
+	}
+	defer reader.Close()
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		logger.Debugf("prefetching %s: %s", first.GetFilePath(), err)
+		return
+	}
+	p.reads.Add(1)
+
+	for _, ref := range run {
+		start := ref.dobj.GetOffset() - offset
+		part := data[start : start+ref.dobj.GetSize() : start+ref.dobj.GetSize()]
+		if err := verifyData(ref.c.Hash(), ref.dobj, part); err != nil {
+			logger.Debugf("prefetching %s: %s", ref.c, err)
+			continue
+		}
+		p.put(ref.c, part)
+	}
+}
+
+// put buffers the data of c, dropping the oldest buffered blocks beyond the
+// limit.
+func (p *prefetcher) put(c cid.Cid, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.buffered[c]; ok {
+		return
+	}
+	p.buffered[c] = p.order.PushBack(&prefetched{c: c, data: data})
+	p.used += int64(len(data))
+	p.fetched.Add(1)
+
+	for p.used > p.limit {
+		p.remove(p.order.Front())
+		p.dropped.Add(1)
+	}
+}
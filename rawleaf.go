@@ -0,0 +1,103 @@
+package remotestore
+
+import (
+	"context"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// RawLeafPolicy decides what Put and PutMany do with the raw blocks which
+// are not FilestoreNodes, like the ones received over bitswap.
+type RawLeafPolicy int
+
+const (
+	// RawLeafStore stores them in the main blockstore like any block.
+	RawLeafStore RawLeafPolicy = iota
+	// RawLeafReject rejects them with a RawLeafError.
+	RawLeafReject
+	// RawLeafVerify accepts them only if their data matches a reference of
+	// the RemoteManager, which keeps serving it, and rejects them with a
+	// RawLeafError otherwise.
+	RawLeafVerify
+)
+
+func (p RawLeafPolicy) String() string {
+	switch p {
+	case RawLeafStore:
+		return "store"
+	case RawLeafReject:
+		return "reject"
+	case RawLeafVerify:
+		return "verify"
+	default:
+		return fmt.Sprintf("RawLeafPolicy(%d)", int(p))
+	}
+}
+
+// WithRawLeafPolicy sets the policy for the raw blocks put in the
+// Remotestore, RawLeafStore by default.
+func WithRawLeafPolicy(p RawLeafPolicy) Option {
+	return func(f *Remotestore) {
+		f.rawLeaves = p
+	}
+}
+
+// RawLeafError is returned when a raw block is rejected by the raw leaf
+// policy.
+type RawLeafError struct {
+	Block  blocks.Block
+	Policy RawLeafPolicy
+	// Err is the reason the block doesn't match a reference with
+	// RawLeafVerify.
+	Err error
+}
+
+func (e *RawLeafError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("raw block %s rejected by policy %s: %s", e.Block.Cid(), e.Policy, e.Err)
+	}
+	return fmt.Sprintf("raw block %s rejected by policy %s", e.Block.Cid(), e.Policy)
+}
+
+func (e *RawLeafError) Unwrap() error {
+	return e.Err
+}
+
+// rawLeaf applies the raw leaf policy to b, which is a raw block. It
+// reports whether b is stored in the main blockstore.
+func (f *Remotestore) rawLeaf(ctx context.Context, b blocks.Block) (bool, error) {
+	switch f.rawLeaves {
+	case RawLeafStore:
+		return true, nil
+	case RawLeafVerify:
+		if err := f.verifyRawLeaf(ctx, b); err != nil {
+			return false, &RawLeafError{Block: b, Policy: f.rawLeaves, Err: err}
+		}
+		return false, nil
+	default:
+		return false, &RawLeafError{Block: b, Policy: f.rawLeaves}
+	}
+}
+
+func (f *Remotestore) verifyRawLeaf(ctx context.Context, b blocks.Block) error {
+	size, err := f.remoteGetSize(ctx, b.Cid())
+	if ipld.IsNotFound(err) {
+		return fmt.Errorf("no reference")
+	} else if err != nil {
+		return err
+	}
+
+	if size != len(b.RawData()) {
+		return fmt.Errorf("size %d doesn't match the reference size %d", len(b.RawData()), size)
+	}
+	sum, err := b.Cid().Prefix().Sum(b.RawData())
+	if err != nil {
+		return err
+	}
+	if !sum.Equals(b.Cid()) {
+		return fmt.Errorf("data doesn't match the cid")
+	}
+	return nil
+}
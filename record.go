@@ -0,0 +1,400 @@
+package remotestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	dshelp "github.com/ipfs/boxo/datastore/dshelp"
+	pb "github.com/ipfs/boxo/filestore/pb"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RecordVersion is the version of the reference records written by the
+// RemoteManager. Records of version 0 are the plain pb.DataObj values
+// written before records were versioned.
+const RecordVersion = 1
+
+// RemotestoreMigrationPrefix identifies the key prefix for the state of the
+// running record migration.
+var RemotestoreMigrationPrefix = ds.NewKey("remotestore-migration")
+
+// Fields of a record. The first ones are the fields of pb.DataObj, so that
+// a record is a valid pb.DataObj, and a pb.DataObj a record of version 0.
+// Rewriting a record as a pb.DataObj keeps the other fields.
+const (
+	recordPath      protowire.Number = 1
+	recordOffset    protowire.Number = 2
+	recordSize      protowire.Number = 3
+	recordVersion   protowire.Number = 16
+	recordETag      protowire.Number = 17
+	recordVersionID protowire.Number = 18
+	recordModTime   protowire.Number = 19
+	recordSourceID  protowire.Number = 20
+	recordCreated   protowire.Number = 21
+	recordUpdated   protowire.Number = 22
+)
+
+// Record is a reference as stored by the RemoteManager: where the data of
+// a block is, and what was known of its object when it was recorded.
+type Record struct {
+	Version int
+	Path    string
+	Offset  uint64
+	Size    uint64
+
+	// ETag, VersionID and ModTime identify the version of the object the
+	// reference was recorded from, if the source could tell.
+	ETag      string
+	VersionID string
+	ModTime   time.Time
+	// SourceID is the source the reference was recorded from, see
+	// WithSourceID.
+	SourceID string
+	// Created is when the reference was recorded, and Updated when the
+	// record was last written. Created is unknown for migrated records.
+	Created time.Time
+	Updated time.Time
+}
+
+// WithSourceID records id as the source of the references written by the
+// RemoteManager.
+func WithSourceID(id string) ManagerOption {
+	return func(f *RemoteManager) {
+		f.sourceID = id
+	}
+}
+
+func (r *Record) dataObj() *pb.DataObj {
+	return &pb.DataObj{
+		FilePath: &r.Path,
+		Offset:   &r.Offset,
+		Size:     &r.Size,
+	}
+}
+
+func appendTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(t.UnixNano()))
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// marshalRecord encodes r with the current version.
+func marshalRecord(r *Record) []byte {
+	var b []byte
+	b = appendString(b, recordPath, r.Path)
+	b = protowire.AppendTag(b, recordOffset, protowire.VarintType)
+	b = protowire.AppendVarint(b, r.Offset)
+	b = protowire.AppendTag(b, recordSize, protowire.VarintType)
+	b = protowire.AppendVarint(b, r.Size)
+
+	b = protowire.AppendTag(b, recordVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, RecordVersion)
+	b = appendString(b, recordETag, r.ETag)
+	b = appendString(b, recordVersionID, r.VersionID)
+	b = appendTime(b, recordModTime, r.ModTime)
+	b = appendString(b, recordSourceID, r.SourceID)
+	b = appendTime(b, recordCreated, r.Created)
+	b = appendTime(b, recordUpdated, r.Updated)
+	return b
+}
+
+// unmarshalRecord decodes a record of any version. The fields it does not
+// know, e.g. of a newer version, are skipped.
+func unmarshalRecord(b []byte) (*Record, error) {
+	var r Record
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var (
+			v uint64
+			s string
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			s, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case recordPath:
+			r.Path = s
+		case recordOffset:
+			r.Offset = v
+		case recordSize:
+			r.Size = v
+		case recordVersion:
+			r.Version = int(v)
+		case recordETag:
+			r.ETag = s
+		case recordVersionID:
+			r.VersionID = s
+		case recordModTime:
+			r.ModTime = time.Unix(0, protowire.DecodeZigZag(v))
+		case recordSourceID:
+			r.SourceID = s
+		case recordCreated:
+			r.Created = time.Unix(0, protowire.DecodeZigZag(v))
+		case recordUpdated:
+			r.Updated = time.Unix(0, protowire.DecodeZigZag(v))
+		}
+	}
+	return &r, nil
+}
+
+// newRecord returns the record of a new reference to path, filled with
+// what is known of the object.
+func (f *RemoteManager) newRecord(path string, offset, size uint64) *Record {
+	now := time.Now()
+	r := &Record{
+		Version:  RecordVersion,
+		Path:     path,
+		Offset:   offset,
+		Size:     size,
+		SourceID: f.sourceID,
+		Created:  now,
+		Updated:  now,
+	}
+	if v, ok := f.indexing.Load(path); ok {
+		info := v.(*ObjectInfo)
+		r.ETag = info.ETag
+		r.VersionID = info.VersionID
+		r.ModTime = info.ModTime
+	}
+	return r
+}
+
+// startIndexing makes the references to path written until the returned
+// function is called carry info.
+func (f *RemoteManager) startIndexing(path string, info *ObjectInfo) func() {
+	if info == nil {
+		return func() {}
+	}
+	path = filepath.ToSlash(path)
+	f.indexing.Store(path, info)
+	return func() {
+		f.indexing.CompareAndDelete(path, info)
+	}
+}
+
+// Record returns the record of the primary location of the block c.
+func (f *RemoteManager) Record(ctx context.Context, c cid.Cid) (*Record, error) {
+	data, err := f.ds.Get(ctx, dshelp.MultihashToDsKey(c.Hash()))
+	switch err {
+	case ds.ErrNotFound:
+		return nil, ipld.ErrNotFound{Cid: c}
+	case nil:
+	default:
+		return nil, err
+	}
+
+	return unmarshalRecord(data)
+}
+
+// MigrationProgress reports the progress of MigrateRecords.
+type MigrationProgress struct {
+	// Scanned counts the records read, and Migrated the ones upgraded.
+	Scanned  int
+	Migrated int
+}
+
+// MigrateOptions tunes MigrateRecords.
+type MigrateOptions struct {
+	// BatchSize is the number of records upgraded at once, 1024 by
+	// default.
+	BatchSize int
+
+	// Progress is called after each batch.
+	Progress func(MigrationProgress)
+}
+
+// MigrateRecords upgrades the references and alternative locations whose
+// record is older than RecordVersion, filling in what was recorded of
+// their object. It runs along with the other operations of the
+// RemoteManager, the records they delete or rewrite meanwhile are left
+// alone, and resumes where it stopped when called again after being
+// interrupted. It returns the number of upgraded records.
+func (f *RemoteManager) MigrateRecords(ctx context.Context, opts MigrateOptions) (int, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1024
+	}
+
+	var progress MigrationProgress
+	for _, phase := range []struct {
+		name string
+		d    ds.Batching
+	}{
+		{"refs", f.ds},
+		{"locations", f.locations},
+	} {
+		if err := f.migrate(ctx, phase.name, phase.d, opts, &progress); err != nil {
+			return progress.Migrated, err
+		}
+	}
+	return progress.Migrated, nil
+}
+
+// migrate upgrades the records of d. The last key of each committed batch
+// is saved, so that an interrupted migration restarts after it.
+func (f *RemoteManager) migrate(ctx context.Context, phase string, d ds.Batching, opts MigrateOptions, progress *MigrationProgress) error {
+	cursorKey := ds.NewKey(phase)
+
+	q := dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}}
+	cursor, err := f.migration.Get(ctx, cursorKey)
+	switch err {
+	case nil:
+		q.Filters = []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: string(cursor)}}
+	case ds.ErrNotFound:
+	default:
+		return err
+	}
+
+	qr, err := d.Query(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer qr.Close()
+
+	var (
+		keys []ds.Key
+		last string
+	)
+	objects := make(map[string]*ObjectInfo)
+	commit := func() error {
+		n, err := f.upgrade(ctx, d, keys, objects)
+		progress.Migrated += n
+		if err != nil {
+			return err
+		}
+		if last != "" {
+			if err := f.migration.Put(ctx, cursorKey, []byte(last)); err != nil {
+				return err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(*progress)
+		}
+
+		keys = keys[:0]
+		clear(objects)
+		return nil
+	}
+
+	for {
+		r, ok := qr.NextSync()
+		if !ok {
+			break
+		}
+		if r.Error != nil {
+			return r.Error
+		}
+		progress.Scanned++
+		last = r.Key
+
+		rec, err := unmarshalRecord(r.Value)
+		if err != nil {
+			logger.Warnf("skipping corrupt record %s: %s", r.Key, err)
+			continue
+		}
+		if rec.Version >= RecordVersion {
+			continue
+		}
+
+		keys = append(keys, ds.RawKey(r.Key))
+		if len(keys) == opts.BatchSize {
+			if err := commit(); err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := commit(); err != nil {
+		return err
+	}
+	return f.migration.Delete(ctx, cursorKey)
+}
+
+// upgrade upgrades the records of d at keys. It reads them again while
+// holding the writes of references off, so that a record deleted or
+// rewritten since it was scanned is neither brought back nor overwritten.
+// It returns the number of upgraded records.
+func (f *RemoteManager) upgrade(ctx context.Context, d ds.Batching, keys []ds.Key, objects map[string]*ObjectInfo) (int, error) {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range keys {
+		data, err := d.Get(ctx, key)
+		if err == ds.ErrNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		rec, err := unmarshalRecord(data)
+		if err != nil || rec.Version >= RecordVersion {
+			continue
+		}
+
+		info, ok := objects[rec.Path]
+		if !ok {
+			info, err = f.ObjectInfo(ctx, filepath.FromSlash(rec.Path))
+			if err != nil && !errors.Is(err, ds.ErrNotFound) {
+				return 0, fmt.Errorf("reading object info of %s: %w", rec.Path, err)
+			}
+			objects[rec.Path] = info
+		}
+		if info != nil {
+			rec.ETag = info.ETag
+			rec.VersionID = info.VersionID
+			rec.ModTime = info.ModTime
+		}
+		rec.SourceID = f.sourceID
+		rec.Updated = time.Now()
+
+		if err := batch.Put(ctx, key, marshalRecord(rec)); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,78 @@
+package remotestore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"sync"
+
+	"github.com/samber/oops"
+)
+
+// Credential holds the secrets a source needs to access its backend.
+type Credential struct {
+	AccessKeyID     string `json:"access_key_id" yaml:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key" yaml:"secret_access_key"`
+	SessionToken    string `json:"session_token,omitempty" yaml:"session_token,omitempty"`
+}
+
+// SourceFactory builds a RemoteSource from its URI. cred is nil when no
+// credential is configured for the source.
+type SourceFactory func(ctx context.Context, u *url.URL, cred *Credential) (RemoteSource, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]SourceFactory{}
+)
+
+// RegisterSource makes a source available under the given URI scheme.
+// Source packages usually call it from their init function. It panics if
+// the scheme is registered twice or if factory is nil.
+func RegisterSource(scheme string, factory SourceFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("remotestore: RegisterSource factory is nil")
+	}
+	if _, dup := registry[scheme]; dup {
+		panic(fmt.Sprintf("remotestore: RegisterSource called twice for scheme %s", scheme))
+	}
+	registry[scheme] = factory
+}
+
+// Schemes returns the sorted list of registered URI schemes.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	slices.Sort(schemes)
+	return schemes
+}
+
+// OpenSource builds the source described by uri with the factory registered
+// for its scheme.
+func OpenSource(ctx context.Context, uri string, cred *Credential) (RemoteSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, oops.Wrapf(err, "failed to parse source uri %s", uri)
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[u.Scheme]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, oops.Errorf("unknown source scheme %q", u.Scheme)
+	}
+
+	source, err := factory(ctx, u, cred)
+	if err != nil {
+		return nil, oops.Wrapf(err, "failed to open source %s", uri)
+	}
+	return source, nil
+}
@@ -9,6 +9,10 @@ package remotestore
 
 import (
 	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
 
 	"github.com/ipfs/boxo/blockservice"
 	blockstore "github.com/ipfs/boxo/blockstore"
@@ -24,12 +28,16 @@ import (
 	dsq "github.com/ipfs/go-datastore/query"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/samber/oops"
 )
 
 var logger = logging.Logger("remotestore")
 
-var _ blockstore.Blockstore = (*Remotestore)(nil)
+var (
+	_ blockstore.Blockstore = (*Remotestore)(nil)
+	_ blockstore.Viewer     = (*Remotestore)(nil)
+)
 
 // Remotestore implements a Blockstore by combining a standard Blockstore
 // to store regular blocks and a special Blockstore called
@@ -37,6 +45,36 @@ var _ blockstore.Blockstore = (*Remotestore)(nil)
 type Remotestore struct {
 	fm *RemoteManager
 	bs blockstore.Blockstore
+
+	cache    CachePolicy
+	prefetch *prefetcher
+	flight   flightGroup
+	bloom    *bloomFilter
+	negative *arcCache
+
+	rawLeaves RawLeafPolicy
+
+	// claims coordinate the writes with the rollback of the syncs.
+	claims writeClaims
+
+	// managers are the managers serving references in lookup order, fm
+	// and the extra ones.
+	managers []*RemoteManager
+	extra    []prioritizedManager
+
+	// cancel stops the background work, which Close waits for with
+	// background, and unwatch stops the managers reporting their writes.
+	cancel     context.CancelFunc
+	background sync.WaitGroup
+	unwatch    []func()
+}
+
+type Option func(*Remotestore)
+
+// WithoutCache stops Get from copying the remote blocks it reads into the
+// main blockstore, it is WithCachePolicy(NeverCache()).
+func WithoutCache() Option {
+	return WithCachePolicy(NeverCache())
 }
 
 // RemoteManager returns the RemoteManager in Filestore.
@@ -50,8 +88,50 @@ func (f *Remotestore) MainBlockstore() blockstore.Blockstore {
 }
 
 // NewRemotestore creates one using the given Blockstore and FileManager.
-func NewRemotestore(bs blockstore.Blockstore, fm *RemoteManager) *Remotestore {
-	return &Remotestore{fm, bs}
+func NewRemotestore(bs blockstore.Blockstore, fm *RemoteManager, opts ...Option) *Remotestore {
+	f := &Remotestore{fm: fm, bs: bs, cache: AlwaysCache()}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	f.orderManagers()
+	if s, ok := f.cache.(CacheSeeder); ok {
+		f.seedCache(context.Background(), s)
+	}
+	if f.prefetch != nil {
+		f.prefetch.managers = f.managers
+	}
+	f.watchManagers()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	if f.bloom != nil {
+		f.background.Add(1)
+		go func() {
+			defer f.background.Done()
+			if err := f.RebuildBloom(ctx); err != nil && ctx.Err() == nil {
+				logger.Errorf("building bloom filter: %s", err)
+			}
+		}()
+	}
+
+	return f
+}
+
+// Close stops the background work of the Remotestore, like the running
+// prefetches or the build of the bloom filter. It closes neither the
+// blockstore nor the sources.
+func (f *Remotestore) Close() error {
+	f.cancel()
+	f.prefetch.close()
+	f.background.Wait()
+
+	for _, unwatch := range f.unwatch {
+		unwatch()
+	}
+	f.unwatch = nil
+	return nil
 }
 
 // AllKeysChan returns a channel from which to read the keys stored in
@@ -91,27 +171,29 @@ func (f *Remotestore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
 		// Can't do these at the same time because the abstractions around
 		// leveldb make us query leveldb for both operations. We apparently
 		// cant query leveldb concurrently
-		b, err := f.fm.AllKeysChan(ctx)
-		if err != nil {
-			logger.Error("error querying filestore: ", err)
-			return
-		}
+		for _, fm := range f.managers {
+			b, err := fm.AllKeysChan(ctx)
+			if err != nil {
+				logger.Error("error querying filestore: ", err)
+				return
+			}
 
-		done = false
-		for !done {
-			select {
-			case c, ok := <-b:
-				if !ok {
-					done = true
-					continue
-				}
+			done = false
+			for !done {
 				select {
-				case out <- c:
+				case c, ok := <-b:
+					if !ok {
+						done = true
+						continue
+					}
+					select {
+					case out <- c:
+					case <-ctx.Done():
+						return
+					}
 				case <-ctx.Done():
 					return
 				}
-			case <-ctx.Done():
-				return
 			}
 		}
 	}()
@@ -127,8 +209,21 @@ func (f *Remotestore) DeleteBlock(ctx context.Context, c cid.Cid) error {
 	if err1 != nil && !ipld.IsNotFound(err1) {
 		return err1
 	}
+	f.cache.Forget(c)
+	if err := f.fm.unmarkCached(ctx, c); err != nil {
+		return err
+	}
 
-	err2 := f.fm.DeleteBlock(ctx, c)
+	// the block is gone from every manager
+	var err2 error = ipld.ErrNotFound{Cid: c}
+	for _, fm := range f.managers {
+		err := fm.DeleteBlock(ctx, c)
+		if err == nil {
+			err2 = nil
+		} else if !ipld.IsNotFound(err) {
+			return err
+		}
+	}
 
 	// if we successfully removed something from the blockstore, but the
 	// filestore didnt have it, return success
@@ -136,6 +231,7 @@ func (f *Remotestore) DeleteBlock(ctx context.Context, c cid.Cid) error {
 		return err2
 	}
 
+	f.missed(c)
 	if ipld.IsNotFound(err1) {
 		return err1
 	}
@@ -146,25 +242,187 @@ func (f *Remotestore) DeleteBlock(ctx context.Context, c cid.Cid) error {
 // Get retrieves the block with the given Cid. It may return
 // ErrNotFound when the block is not stored.
 func (f *Remotestore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if b, ok := identityBlock(c); ok {
+		return b, nil
+	}
+	if f.missing(c) {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+
 	blk, err := f.bs.Get(ctx, c)
+	if err == nil && !f.cache.Hit(c) {
+		// stale copy of a remote block
+		evicted, eerr := f.evict(ctx, c)
+		if eerr != nil {
+			return nil, eerr
+		}
+		if !evicted {
+			return blk, nil
+		}
+		err = ipld.ErrNotFound{Cid: c}
+	}
+	if err == nil {
+		f.prefetch.node(c, blk.RawData())
+	}
 	if ipld.IsNotFound(err) {
-		block, err := f.fm.Get(ctx, c)
+		// concurrent requests share the read and the cached copy
+		blk, err := f.flight.do(ctx, string(c.Hash()), func(ctx context.Context) (blocks.Block, error) {
+			return f.getRemote(ctx, c)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return withCid(blk, c)
+	}
+	return blk, err
+}
+
+func (f *Remotestore) getRemote(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if data, ok := f.prefetch.take(c); ok {
+		blk, err := blocks.NewBlockWithCid(data, c)
 		if err == nil {
-			// cache remote block in local blockstore
-			_ = f.bs.Put(ctx, block)
+			f.cacheBlock(ctx, blk)
 		}
-		return block, err
+		return blk, err
+	}
+
+	blk, err := f.remoteGet(ctx, c)
+	if err == nil {
+		f.cacheBlock(ctx, blk)
+	} else if ipld.IsNotFound(err) {
+		f.missed(c)
 	}
 	return blk, err
 }
 
+// errStaleCopy is returned by the view of a stale cached copy.
+var errStaleCopy = errors.New("stale cached copy")
+
+// View calls fn with the data of the block with the given Cid, without
+// copying it when the main blockstore is a blockstore.Viewer or the block
+// is read from the source. The data is only valid during the call. It may
+// return ErrNotFound when the block is not stored.
+func (f *Remotestore) View(ctx context.Context, c cid.Cid, fn func([]byte) error) error {
+	if b, ok := identityBlock(c); ok {
+		return fn(b.RawData())
+	}
+	if f.missing(c) {
+		return ipld.ErrNotFound{Cid: c}
+	}
+
+	err := f.viewLocal(ctx, c, func(data []byte) error {
+		if !f.cache.Hit(c) {
+			return errStaleCopy
+		}
+		f.prefetch.node(c, data)
+		return fn(data)
+	})
+	if errors.Is(err, errStaleCopy) {
+		evicted, eerr := f.evict(ctx, c)
+		if eerr != nil {
+			return eerr
+		}
+		if !evicted {
+			return f.viewLocal(ctx, c, fn)
+		}
+		err = ipld.ErrNotFound{Cid: c}
+	}
+	if !ipld.IsNotFound(err) {
+		return err
+	}
+
+	if data, ok := f.prefetch.take(c); ok {
+		if err := fn(data); err != nil {
+			return err
+		}
+		if blk, err := blocks.NewBlockWithCid(data, c); err == nil {
+			f.cacheBlock(ctx, blk)
+		}
+		return nil
+	}
+
+	err = f.remoteView(ctx, c, func(data []byte) error {
+		if err := fn(data); err != nil {
+			return err
+		}
+		if f.admit(ctx, c, len(data)) {
+			blk, err := blocks.NewBlockWithCid(append([]byte(nil), data...), c)
+			if err == nil {
+				f.store(ctx, blk)
+			}
+		}
+		return nil
+	})
+	if ipld.IsNotFound(err) {
+		f.missed(c)
+	}
+	return err
+}
+
+func (f *Remotestore) viewLocal(ctx context.Context, c cid.Cid, fn func([]byte) error) error {
+	if v, ok := f.bs.(blockstore.Viewer); ok {
+		return v.View(ctx, c, fn)
+	}
+
+	blk, err := f.bs.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	return fn(blk.RawData())
+}
+
+// cacheBlock copies the remote block b in the main blockstore if the cache
+// policy admits it.
+func (f *Remotestore) cacheBlock(ctx context.Context, b blocks.Block) {
+	if f.admit(ctx, b.Cid(), len(b.RawData())) {
+		f.store(ctx, b)
+	}
+}
+
+// admit reports whether the cache policy admits the remote block c of
+// size bytes, and evicts the copies it replaces.
+func (f *Remotestore) admit(ctx context.Context, c cid.Cid, size int) bool {
+	admit, evicted := f.cache.Admit(c, size)
+	for _, c := range evicted {
+		if _, err := f.evict(ctx, c); err != nil {
+			logger.Errorf("evicting cached block %s: %s", c, err)
+		}
+	}
+	return admit
+}
+
+// store writes the cached copy of the remote block b. The copy is recorded
+// before it is written, so that it is never mistaken for a regular block.
+func (f *Remotestore) store(ctx context.Context, b blocks.Block) {
+	err := f.fm.markCached(ctx, b.Cid(), len(b.RawData()))
+	if err == nil {
+		err = f.bs.Put(ctx, b)
+	}
+	if err != nil {
+		logger.Errorf("caching block %s: %s", b.Cid(), err)
+		f.cache.Forget(b.Cid())
+		_ = f.fm.unmarkCached(ctx, b.Cid())
+	}
+}
+
 // GetSize returns the size of the requested block. It may return ErrNotFound
 // when the block is not stored.
 func (f *Remotestore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if b, ok := identityBlock(c); ok {
+		return len(b.RawData()), nil
+	}
+	if f.missing(c) {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+
 	size, err := f.bs.GetSize(ctx, c)
 	if err != nil {
 		if ipld.IsNotFound(err) {
-			return f.fm.GetSize(ctx, c)
+			size, err = f.remoteGetSize(ctx, c)
+			if ipld.IsNotFound(err) {
+				f.missed(c)
+			}
+			return size, err
 		}
 		return -1, err
 	}
@@ -172,8 +430,15 @@ func (f *Remotestore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
 }
 
 // Has returns true if the block with the given Cid is
-// stored in the Filestore.
+// stored in the Filestore, or inlined in an identity Cid.
 func (f *Remotestore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if _, ok := identityBlock(c); ok {
+		return true, nil
+	}
+	if f.missing(c) {
+		return false, nil
+	}
+
 	has, err := f.bs.Has(ctx, c)
 	if err != nil {
 		return false, err
@@ -183,14 +448,47 @@ func (f *Remotestore) Has(ctx context.Context, c cid.Cid) (bool, error) {
 		return true, nil
 	}
 
-	return f.fm.Has(ctx, c)
+	has, err = f.remoteHas(ctx, c)
+	if err == nil && !has {
+		f.missed(c)
+	}
+	return has, err
 }
 
 // Put stores a block in the Filestore. For blocks of
 // underlying type FilestoreNode, the operation is
-// delegated to the FileManager, while the rest of blocks
-// are handled by the regular blockstore.
+// delegated to the FileManager, which records it as another
+// location of a block it already has, while the rest of blocks
+// are handled by the regular blockstore, raw blocks according to
+// the RawLeafPolicy. The blocks with an identity CID, which holds their
+// data, are not stored.
 func (f *Remotestore) Put(ctx context.Context, b blocks.Block) error {
+	defer f.claims.lock(b.Cid())()
+	// a block a running sync wrote is no longer its own to roll back
+	f.claims.share(nil, b.Cid())
+	return f.put(ctx, b)
+}
+
+func (f *Remotestore) put(ctx context.Context, b blocks.Block) error {
+	if _, ok := identityBlock(b.Cid()); ok {
+		return nil
+	}
+	if b, ok := b.(*posinfo.FilestoreNode); ok {
+		return f.fm.Put(ctx, b)
+	}
+
+	if IsRawNodeCid(b.Cid()) {
+		store, err := f.rawLeaf(ctx, b)
+		if err != nil || !store {
+			return err
+		}
+	}
+
+	// a regular block put over a cached copy must outlive its reference
+	if err := f.keep(ctx, b.Cid()); err != nil {
+		return err
+	}
+
 	has, err := f.Has(ctx, b.Cid())
 	if err != nil {
 		return err
@@ -200,38 +498,60 @@ func (f *Remotestore) Put(ctx context.Context, b blocks.Block) error {
 		return nil
 	}
 
-	switch b := b.(type) {
-	case *posinfo.FilestoreNode:
-		return f.fm.Put(ctx, b)
-	default:
-		// skip bitswap raw nodes
-		if !IsRawNodeCid(b.Cid()) {
-			return f.bs.Put(ctx, b)
-		}
-		return nil
+	if err := f.bs.Put(ctx, b); err != nil {
+		return err
 	}
+	f.added(b.Cid().Hash())
+	return nil
 }
 
 // PutMany is like Put(), but takes a slice of blocks, allowing
 // the underlying blockstore to perform batch transactions.
 func (f *Remotestore) PutMany(ctx context.Context, bs []blocks.Block) error {
+	cids := blockCids(bs)
+	defer f.claims.lock(cids...)()
+	f.claims.share(nil, cids...)
+	return f.putMany(ctx, bs)
+}
+
+func (f *Remotestore) putMany(ctx context.Context, bs []blocks.Block) error {
+	var regulars []blocks.Block
 	var normals []blocks.Block
 	var fstores []*posinfo.FilestoreNode
 
+	// the whole batch is rejected before anything is written
 	for _, b := range bs {
-		has, err := f.Has(ctx, b.Cid())
-		if err != nil {
+		if _, ok := identityBlock(b.Cid()); ok {
+			continue
+		}
+		if b, ok := b.(*posinfo.FilestoreNode); ok {
+			fstores = append(fstores, b)
+			continue
+		}
+
+		if IsRawNodeCid(b.Cid()) {
+			store, err := f.rawLeaf(ctx, b)
+			if err != nil {
+				return err
+			}
+			if !store {
+				continue
+			}
+		}
+		regulars = append(regulars, b)
+	}
+
+	for _, b := range regulars {
+		if err := f.keep(ctx, b.Cid()); err != nil {
 			return err
 		}
 
-		if has {
-			continue
+		has, err := f.Has(ctx, b.Cid())
+		if err != nil {
+			return err
 		}
 
-		switch b := b.(type) {
-		case *posinfo.FilestoreNode:
-			fstores = append(fstores, b)
-		default:
+		if !has {
 			normals = append(normals, b)
 		}
 	}
@@ -241,13 +561,13 @@ func (f *Remotestore) PutMany(ctx context.Context, bs []blocks.Block) error {
 		if err != nil {
 			return err
 		}
+		for _, b := range normals {
+			f.added(b.Cid().Hash())
+		}
 	}
 
 	if len(fstores) > 0 {
-		err := f.fm.PutMany(ctx, fstores)
-		if err != nil {
-			return err
-		}
+		return f.fm.PutMany(ctx, fstores)
 	}
 	return nil
 }
@@ -266,6 +586,104 @@ type SyncIndexOptions struct {
 
 	// default is "balanced"
 	Layout string
+
+	// CidVersion is the version of the CIDs of the DAG nodes, 0 by
+	// default. The leaves are raw blocks, which always have a CIDv1.
+	CidVersion int
+
+	// HashFunction is the name of the multihash function, e.g. "blake3",
+	// default is "sha2-256". Other functions imply CIDv1, like with
+	// `ipfs add --hash`.
+	HashFunction string
+
+	// InlineLimit inlines the blocks up to this size into their CID with
+	// the identity hash, like `ipfs add --inline-limit`. 0 disables it.
+	InlineLimit int
+
+	// WrapSingleBlock stores an object fitting in a single block as a
+	// dag-pb file node holding the data, like `ipfs add --raw-leaves=false`,
+	// instead of making the raw leaf referencing it the root.
+	WrapSingleBlock bool
+}
+
+// cidBuilder returns the builder of the CIDs of the DAG nodes.
+func (o SyncIndexOptions) cidBuilder() (cid.Builder, error) {
+	version, hash := o.CidVersion, uint64(mh.SHA2_256)
+	if o.HashFunction != "" {
+		code, ok := mh.Names[strings.ToLower(o.HashFunction)]
+		if !ok {
+			return nil, oops.Errorf("unknown hash function: %s", o.HashFunction)
+		}
+		hash = code
+	}
+	if hash != mh.SHA2_256 && version == 0 {
+		version = 1
+	}
+
+	prefix, err := merkledag.PrefixForCidVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	prefix.MhType = hash
+	prefix.MhLength = -1
+
+	if o.InlineLimit > 0 {
+		return inlineBuilder{&prefix, o.InlineLimit}, nil
+	}
+	return &prefix, nil
+}
+
+// inlineBuilder builds identity CIDs for the blocks up to limit bytes.
+type inlineBuilder struct {
+	cid.Builder
+	limit int
+}
+
+func (b inlineBuilder) Sum(data []byte) (cid.Cid, error) {
+	if len(data) > b.limit {
+		return b.Builder.Sum(data)
+	}
+	return cid.V1Builder{Codec: b.GetCodec(), MhType: mh.IDENTITY}.Sum(data)
+}
+
+func (b inlineBuilder) WithCodec(c uint64) cid.Builder {
+	return inlineBuilder{b.Builder.WithCodec(c), b.limit}
+}
+
+// peekSplitter is a chunk.Splitter which has read its first chunks ahead.
+type peekSplitter struct {
+	chunk.Splitter
+	chunks [][]byte
+	err    error
+}
+
+// peek reads up to n chunks ahead. It reports whether the splitter has no
+// more chunks than the ones read.
+func (s *peekSplitter) peek(n int) (bool, error) {
+	for len(s.chunks) < n {
+		data, err := s.Splitter.NextBytes()
+		if err == io.EOF {
+			s.err = err
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		s.chunks = append(s.chunks, data)
+	}
+	return false, nil
+}
+
+func (s *peekSplitter) NextBytes() ([]byte, error) {
+	if len(s.chunks) > 0 {
+		data := s.chunks[0]
+		s.chunks = s.chunks[1:]
+		return data, nil
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.Splitter.NextBytes()
 }
 
 func (f *Remotestore) SyncIndex(ctx context.Context, key string, opts SyncIndexOptions) (ipld.Node, error) {
@@ -289,6 +707,28 @@ type SyncResult struct {
 
 func (f *Remotestore) SyncIndexAsync(ctx context.Context, key string, opts SyncIndexOptions) (<-chan SyncResult, *Progress, error) {
 	source := f.fm.source
+
+	key, err := f.fm.NormalizeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builder, err := opts.cidBuilder()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// stat first, so the recorded fingerprint can only be older than the
+	// content we index and never hide a change
+	var info *ObjectInfo
+	if ss, ok := source.(StatSource); ok {
+		var err error
+		info, err = ss.Stat(ctx, key)
+		if err != nil && !errors.Is(err, ErrNotSupported) {
+			return nil, nil, err
+		}
+	}
+
 	rc, size, err := source.Get(ctx, key)
 	if err != nil {
 		return nil, nil, err
@@ -304,13 +744,15 @@ func (f *Remotestore) SyncIndexAsync(ctx context.Context, key string, opts SyncI
 		},
 	}
 
-	bsrv := blockservice.New(f, offline.Exchange(f))
+	// the writes of the sync are tracked, to be undone if it fails
+	w := newSyncWriter(f, key)
+	bsrv := blockservice.New(w, offline.Exchange(w))
 	dsrv := merkledag.NewDAGService(bsrv)
 
 	params := helpers.DagBuilderParams{
 		Dagserv:    dsrv,
 		Maxlinks:   opts.Maxlinks,
-		CidBuilder: merkledag.V0CidPrefix(),
+		CidBuilder: builder,
 		NoCopy:     true,
 		RawLeaves:  true,
 	}
@@ -324,6 +766,18 @@ func (f *Remotestore) SyncIndexAsync(ctx context.Context, key string, opts SyncI
 		return nil, nil, oops.Wrapf(err, "failed to create chunker from file")
 	}
 
+	if opts.WrapSingleBlock {
+		peeked := &peekSplitter{Splitter: chnk}
+		single, err := peeked.peek(2)
+		if err != nil {
+			rc.Close()
+			return nil, nil, oops.Wrapf(err, "failed to read file")
+		}
+		// the leaf holds the data, it is not a reference
+		params.RawLeaves = !single
+		chnk = peeked
+	}
+
 	dbh, err := params.New(chnk)
 	if err != nil {
 		rc.Close()
@@ -334,25 +788,57 @@ func (f *Remotestore) SyncIndexAsync(ctx context.Context, key string, opts SyncI
 	go func() {
 		defer rc.Close()
 		defer close(ch)
-
-		var n ipld.Node
-		switch opts.Layout {
-		case "trickle":
-			n, err = trickle.Layout(dbh)
-		case "balanced", "":
-			n, err = balanced.Layout(dbh)
-		default:
-			ch <- SyncResult{nil, oops.Wrapf(err, "unknown layout: %s", opts.Layout)}
-			return
+		// the references carry the version of the object they are read from
+		defer f.fm.startIndexing(key, info)()
+
+		res := f.layout(ctx, dbh, opts.Layout, key, size, info)
+		if res.Err != nil {
+			// the context may be done, the rollback must run anyway
+			if err := w.rollback(context.WithoutCancel(ctx)); err != nil {
+				logger.Errorf("rolling back the sync of %s: %s", key, err)
+			}
+		} else {
+			w.release()
 		}
+		ch <- res
+	}()
 
-		if err != nil {
-			ch <- SyncResult{n, oops.Wrapf(err, "failed to layout dag")}
-			return
-		}
+	return ch, progress, nil
+}
 
-		ch <- SyncResult{n, nil}
-	}()
+// layout builds the DAG of key and records the object info along with its
+// root.
+func (f *Remotestore) layout(ctx context.Context, dbh *helpers.DagBuilderHelper, layout, key string, size uint64, info *ObjectInfo) SyncResult {
+	var (
+		n   ipld.Node
+		err error
+	)
+	switch layout {
+	case "trickle":
+		n, err = trickle.Layout(dbh)
+	case "balanced", "":
+		n, err = balanced.Layout(dbh)
+	default:
+		return SyncResult{nil, oops.Errorf("unknown layout: %s", layout)}
+	}
+
+	if err != nil {
+		return SyncResult{n, oops.Wrapf(err, "failed to layout dag")}
+	}
+	// a cancelled read may look like the end of the object
+	if err := ctx.Err(); err != nil {
+		return SyncResult{n, oops.Wrapf(err, "sync cancelled")}
+	}
+
+	// the root is recorded even without a fingerprint, a size alone
+	// is never compared
+	if info == nil {
+		info = &ObjectInfo{Size: size}
+	}
+	info.Root = n.Cid()
+	if err := f.fm.PutObjectInfo(ctx, key, info); err != nil {
+		return SyncResult{n, oops.Wrapf(err, "failed to record object info")}
+	}
 
-	return ch, progress, oops.Wrapf(err, "failed to layout dag")
+	return SyncResult{n, nil}
 }
@@ -0,0 +1,249 @@
+package remotestore
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	posinfo "github.com/ipfs/boxo/filestore/posinfo"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// syncWriter is the Remotestore as seen by a sync of key. It remembers the
+// blocks and references the sync adds, so that they can be removed when
+// the sync fails, leaving the store as it was before.
+type syncWriter struct {
+	*Remotestore
+	path string
+
+	mu sync.Mutex
+	// added are the blocks absent before the sync, and located the blocks
+	// which gained a location in key.
+	added   []cid.Cid
+	located []cid.Cid
+}
+
+func newSyncWriter(f *Remotestore, key string) *syncWriter {
+	return &syncWriter{Remotestore: f, path: filepath.ToSlash(key)}
+}
+
+// writeClaims coordinates the writes of the blocks through a Remotestore
+// with the rollback of the syncs. A block a sync made present is claimed
+// by it, and becomes shared once any other write relies on it, so that a
+// failed sync only removes what nothing else needs.
+type writeClaims struct {
+	// stripes serialize the check and the write of a block, and its
+	// removal by a rollback.
+	stripes [64]sync.Mutex
+
+	mu    sync.Mutex
+	owned map[string]*writeClaim
+}
+
+type writeClaim struct {
+	w      *syncWriter
+	shared bool
+}
+
+// lock locks the writes of the blocks cids, and returns the function
+// unlocking them.
+func (c *writeClaims) lock(cids ...cid.Cid) func() {
+	idx := make([]int, 0, len(cids))
+	for _, k := range cids {
+		m := k.Hash()
+		idx = append(idx, int(m[len(m)-1])%len(c.stripes))
+	}
+	// in a fixed order, so that batches never wait on each other
+	slices.Sort(idx)
+	idx = slices.Compact(idx)
+
+	for _, i := range idx {
+		c.stripes[i].Lock()
+	}
+	return func() {
+		for i := len(idx) - 1; i >= 0; i-- {
+			c.stripes[idx[i]].Unlock()
+		}
+	}
+}
+
+// claim records that w made the block k present, unless another sync
+// claimed it already, which then shares it.
+func (c *writeClaims) claim(w *syncWriter, k cid.Cid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := string(k.Hash())
+	if cl, ok := c.owned[key]; ok {
+		if cl.w != w {
+			cl.shared = true
+		}
+		return
+	}
+	if c.owned == nil {
+		c.owned = make(map[string]*writeClaim)
+	}
+	c.owned[key] = &writeClaim{w: w}
+}
+
+// share records that a write other than the one of w relies on the blocks
+// cids. w is nil for the writes outside of a sync.
+func (c *writeClaims) share(w *syncWriter, cids ...cid.Cid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.owned) == 0 {
+		return
+	}
+	for _, k := range cids {
+		if cl, ok := c.owned[string(k.Hash())]; ok && cl.w != w {
+			cl.shared = true
+		}
+	}
+}
+
+// release drops the claim of w on the block k, and reports whether the
+// rollback of w may remove what it wrote of k.
+func (c *writeClaims) release(w *syncWriter, k cid.Cid) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := string(k.Hash())
+	cl, ok := c.owned[key]
+	if !ok || cl.w != w {
+		return true
+	}
+	delete(c.owned, key)
+	return !cl.shared
+}
+
+// track records what writing b adds to the store. The write of b must be
+// locked.
+func (w *syncWriter) track(ctx context.Context, b blocks.Block) error {
+	c := b.Cid()
+	has, err := w.Remotestore.Has(ctx, c)
+	if err != nil {
+		return err
+	}
+	if has {
+		w.claims.share(w, c)
+	} else {
+		w.claims.claim(w, c)
+	}
+
+	if _, ok := b.(*posinfo.FilestoreNode); ok {
+		has, err := w.fm.index.Has(ctx, indexKey(w.path, c.Hash()))
+		if err != nil || has {
+			return err
+		}
+
+		w.mu.Lock()
+		w.located = append(w.located, c)
+		w.mu.Unlock()
+		return nil
+	}
+
+	if has {
+		return nil
+	}
+
+	w.mu.Lock()
+	w.added = append(w.added, c)
+	w.mu.Unlock()
+	return nil
+}
+
+// Has is the one of the Remotestore, except that the sync relies on the
+// blocks it finds, which are then not written again.
+func (w *syncWriter) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	defer w.claims.lock(c)()
+
+	has, err := w.Remotestore.Has(ctx, c)
+	if has {
+		w.claims.share(w, c)
+	}
+	return has, err
+}
+
+func (w *syncWriter) Put(ctx context.Context, b blocks.Block) error {
+	defer w.claims.lock(b.Cid())()
+
+	if err := w.track(ctx, b); err != nil {
+		return err
+	}
+	return w.Remotestore.put(ctx, b)
+}
+
+func (w *syncWriter) PutMany(ctx context.Context, bs []blocks.Block) error {
+	defer w.claims.lock(blockCids(bs)...)()
+
+	for _, b := range bs {
+		if err := w.track(ctx, b); err != nil {
+			return err
+		}
+	}
+	return w.Remotestore.putMany(ctx, bs)
+}
+
+// release drops the claims of the sync once it succeeded.
+func (w *syncWriter) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, c := range w.added {
+		w.claims.release(w, c)
+	}
+	for _, c := range w.located {
+		w.claims.release(w, c)
+	}
+	w.added, w.located = nil, nil
+}
+
+// rollback removes what the sync added, newest first, except the blocks
+// other writes rely on meanwhile. It keeps going on errors and returns the
+// first one.
+func (w *syncWriter) rollback(ctx context.Context) error {
+	w.mu.Lock()
+	added, located := w.added, w.located
+	w.added, w.located = nil, nil
+	w.mu.Unlock()
+
+	var first error
+	keep := func(err error) {
+		if err != nil && !ipld.IsNotFound(err) && first == nil {
+			first = err
+		}
+	}
+
+	for i := len(added) - 1; i >= 0; i-- {
+		c := added[i]
+		unlock := w.claims.lock(c)
+		if w.claims.release(w, c) {
+			keep(w.Remotestore.DeleteBlock(ctx, c))
+		}
+		unlock()
+	}
+	for i := len(located) - 1; i >= 0; i-- {
+		c := located[i]
+		unlock := w.claims.lock(c)
+		if w.claims.release(w, c) {
+			_, err := w.fm.removeLocation(ctx, c.Hash(), w.path)
+			keep(err)
+		}
+		unlock()
+	}
+
+	return first
+}
+
+// blockCids returns the CIDs of the blocks bs.
+func blockCids(bs []blocks.Block) []cid.Cid {
+	out := make([]cid.Cid, len(bs))
+	for i, b := range bs {
+		out[i] = b.Cid()
+	}
+	return out
+}
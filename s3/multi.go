@@ -0,0 +1,196 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+	"github.com/minio/minio-go/v7"
+	"github.com/samber/oops"
+)
+
+var (
+	_ rs.StatSource = (*MultiSource)(nil)
+	_ rs.ListSource = (*MultiSource)(nil)
+)
+
+// Scheme is the optional URI scheme accepted in front of MultiSource keys.
+const Scheme = "s3://"
+
+// ClientResolver returns the client used to access bucket. It is called at
+// most once per bucket as long as it succeeds. Returning a nil client falls
+// back to the default client of the MultiSource.
+type ClientResolver func(ctx context.Context, bucket string) (*minio.Client, error)
+
+type MultiOption func(*MultiSource)
+
+// WithResolver sets the resolver used to build per-bucket clients, e.g. to
+// use different credentials or endpoints for some buckets.
+func WithResolver(resolve ClientResolver) MultiOption {
+	return func(s *MultiSource) {
+		s.resolve = resolve
+	}
+}
+
+type lazyClient struct {
+	mu     sync.Mutex
+	client *minio.Client
+}
+
+// MultiSource is a RemoteSource spanning several buckets. Its keys carry the
+// bucket they belong to, either as `bucket/key` or as `s3://bucket/key`.
+type MultiSource struct {
+	client  *minio.Client
+	resolve ClientResolver
+
+	mu      sync.Mutex
+	clients map[string]*lazyClient
+}
+
+// NewMulti creates a MultiSource. client is used for every bucket the
+// resolver has no dedicated client for, it may be nil if a resolver is given.
+func NewMulti(client *minio.Client, opts ...MultiOption) *MultiSource {
+	s := &MultiSource{
+		client:  client,
+		clients: map[string]*lazyClient{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// JoinKey builds the MultiSource key of object in bucket.
+func JoinKey(bucket, object string) string {
+	return bucket + "/" + strings.TrimPrefix(object, "/")
+}
+
+// SplitKey splits a MultiSource key into its bucket and object key.
+func SplitKey(key string) (bucket string, object string, err error) {
+	key = strings.TrimPrefix(key, Scheme)
+	key = strings.TrimLeft(key, "/")
+
+	bucket, object, _ = strings.Cut(key, "/")
+	if bucket == "" || object == "" {
+		return "", "", &rs.CorruptReferenceError{
+			Code: rs.StatusOtherError,
+			Err:  oops.Errorf("invalid key %q, expected bucket/key", key),
+		}
+	}
+
+	return bucket, object, nil
+}
+
+func (s *MultiSource) clientFor(ctx context.Context, bucket string) (*minio.Client, error) {
+	if s.resolve == nil {
+		if s.client == nil {
+			return nil, errors.New("no client configured")
+		}
+		return s.client, nil
+	}
+
+	s.mu.Lock()
+	lc, ok := s.clients[bucket]
+	if !ok {
+		lc = &lazyClient{}
+		s.clients[bucket] = lc
+	}
+	s.mu.Unlock()
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.client != nil {
+		return lc.client, nil
+	}
+
+	client, err := s.resolve(ctx, bucket)
+	if err != nil {
+		return nil, oops.Wrapf(err, "failed to resolve client for bucket %s", bucket)
+	}
+
+	if client == nil {
+		client = s.client
+	}
+
+	if client == nil {
+		return nil, oops.Errorf("no client configured for bucket %s", bucket)
+	}
+
+	lc.client = client
+	return client, nil
+}
+
+func (s *MultiSource) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	bucket, object, err := SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.clientFor(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return getPart(ctx, client, bucket, object, offset, size)
+}
+
+func (s *MultiSource) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
+	bucket, object, err := SplitKey(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	client, err := s.clientFor(ctx, bucket)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return get(ctx, client, bucket, object)
+}
+
+func (s *MultiSource) Stat(ctx context.Context, key string) (*rs.ObjectInfo, error) {
+	bucket, object, err := SplitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := s.clientFor(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return stat(ctx, client, bucket, object)
+}
+
+// List lists the objects of the bucket of prefix, which is a MultiSource key
+// whose object part may be empty, e.g. `bucket/`. The keys keep the scheme
+// of prefix.
+func (s *MultiSource) List(ctx context.Context, prefix string, fn func(key string) error) error {
+	scheme := ""
+	if strings.HasPrefix(prefix, Scheme) {
+		scheme = Scheme
+	}
+
+	bucket, object, _ := strings.Cut(strings.TrimLeft(strings.TrimPrefix(prefix, Scheme), "/"), "/")
+	if bucket == "" {
+		return &rs.CorruptReferenceError{
+			Code: rs.StatusOtherError,
+			Err:  oops.Errorf("invalid prefix %q, expected bucket/prefix", prefix),
+		}
+	}
+
+	client, err := s.clientFor(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	return list(ctx, client, bucket, object, func(key string) error {
+		return fn(scheme + JoinKey(bucket, key))
+	})
+}
@@ -0,0 +1,78 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitKey(t *testing.T) {
+	cases := []struct {
+		Key    string
+		Bucket string
+		Object string
+	}{
+		{"bucket/foo", "bucket", "foo"},
+		{"/bucket/foo/bar", "bucket", "foo/bar"},
+		{"s3://bucket/foo/bar", "bucket", "foo/bar"},
+	}
+
+	for _, c := range cases {
+		bucket, object, err := SplitKey(c.Key)
+		require.NoError(t, err)
+		require.Equal(t, c.Bucket, bucket)
+		require.Equal(t, c.Object, object)
+	}
+
+	for _, key := range []string{"", "bucket", "bucket/", "s3://", "/foo"} {
+		_, _, err := SplitKey(key)
+		require.Error(t, err, key)
+	}
+}
+
+func TestMultiSource_Resolver(t *testing.T) {
+	ctx := context.Background()
+
+	def, err := minio.New("localhost:9000", &minio.Options{})
+	require.NoError(t, err)
+	dedicated, err := minio.New("localhost:9001", &minio.Options{})
+	require.NoError(t, err)
+
+	calls := map[string]int{}
+	fail := true
+	s := NewMulti(def, WithResolver(func(ctx context.Context, bucket string) (*minio.Client, error) {
+		calls[bucket]++
+		switch bucket {
+		case "dedicated":
+			return dedicated, nil
+		case "flaky":
+			if fail {
+				fail = false
+				return nil, errors.New("temporary failure")
+			}
+		}
+		return nil, nil
+	}))
+
+	for range 2 {
+		c, err := s.clientFor(ctx, "dedicated")
+		require.NoError(t, err)
+		require.Same(t, dedicated, c)
+
+		c, err = s.clientFor(ctx, "other")
+		require.NoError(t, err)
+		require.Same(t, def, c)
+	}
+	require.Equal(t, 1, calls["dedicated"])
+	require.Equal(t, 1, calls["other"])
+
+	_, err = s.clientFor(ctx, "flaky")
+	require.Error(t, err)
+	c, err := s.clientFor(ctx, "flaky")
+	require.NoError(t, err)
+	require.Same(t, def, c)
+	require.Equal(t, 2, calls["flaky"])
+}
@@ -0,0 +1,64 @@
+package s3
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	rs "github.com/Dreamacro/go-ds-remote"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/samber/oops"
+)
+
+// DefaultEndpoint is the endpoint used when a uri does not set one.
+const DefaultEndpoint = "s3.amazonaws.com"
+
+func init() {
+	rs.RegisterSource("s3", open)
+}
+
+// open builds a source from an uri of the form
+// `s3://bucket?endpoint=host:port&secure=true&region=us-east-1`.
+// Without a bucket it builds a MultiSource whose keys carry their bucket.
+// Without credential, they are read from the standard AWS environment
+// variables.
+func open(ctx context.Context, u *url.URL, cred *rs.Credential) (rs.RemoteSource, error) {
+	if u.Path != "" && u.Path != "/" {
+		return nil, oops.Errorf("s3 uri can't have a path: %s", u.Path)
+	}
+
+	q := u.Query()
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+
+	secure := true
+	if v := q.Get("secure"); v != "" {
+		var err error
+		secure, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, oops.Wrapf(err, "invalid secure parameter")
+		}
+	}
+
+	creds := credentials.NewEnvAWS()
+	if cred != nil {
+		creds = credentials.NewStaticV4(cred.AccessKeyID, cred.SecretAccessKey, cred.SessionToken)
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: q.Get("region"),
+	})
+	if err != nil {
+		return nil, oops.Wrapf(err, "failed to create s3 client")
+	}
+
+	if u.Host == "" {
+		return NewMulti(client), nil
+	}
+	return New(client, u.Host), nil
+}
@@ -3,13 +3,17 @@ package s3
 import (
 	"context"
 	"io"
+	"strings"
 
 	rs "github.com/Dreamacro/go-ds-remote"
 	"github.com/minio/minio-go/v7"
 	"github.com/samber/oops"
 )
 
-var _ rs.RemoteSource = (*Source)(nil)
+var (
+	_ rs.StatSource = (*Source)(nil)
+	_ rs.ListSource = (*Source)(nil)
+)
 
 type Source struct {
 	client *minio.Client
@@ -32,12 +36,28 @@ func New(client *minio.Client, bucket string, opts ...Option) *Source {
 }
 
 func (s *Source) GetPart(ctx context.Context, key string, offset uint64, size uint64) (io.ReadCloser, error) {
+	return getPart(ctx, s.client, s.bucket, key, offset, size)
+}
+
+func (s *Source) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
+	return get(ctx, s.client, s.bucket, key)
+}
+
+func (s *Source) Stat(ctx context.Context, key string) (*rs.ObjectInfo, error) {
+	return stat(ctx, s.client, s.bucket, key)
+}
+
+func (s *Source) List(ctx context.Context, prefix string, fn func(key string) error) error {
+	return list(ctx, s.client, s.bucket, prefix, fn)
+}
+
+func getPart(ctx context.Context, client *minio.Client, bucket, key string, offset uint64, size uint64) (io.ReadCloser, error) {
 	opts := minio.GetObjectOptions{}
 	if err := opts.SetRange(int64(offset), int64(offset+size)); err != nil {
 		return nil, err
 	}
 
-	output, err := s.client.GetObject(ctx, s.bucket, key, opts)
+	output, err := client.GetObject(ctx, bucket, key, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -45,8 +65,8 @@ func (s *Source) GetPart(ctx context.Context, key string, offset uint64, size ui
 	return output, nil
 }
 
-func (s *Source) Get(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
-	output, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+func get(ctx context.Context, client *minio.Client, bucket, key string) (io.ReadCloser, uint64, error) {
+	output, err := client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, 0, oops.Wrapf(err, "failed to get object %s", key)
 	}
@@ -58,3 +78,62 @@ func (s *Source) Get(ctx context.Context, key string) (io.ReadCloser, uint64, er
 
 	return output, uint64(stat.Size), nil
 }
+
+func stat(ctx context.Context, client *minio.Client, bucket, key string) (*rs.ObjectInfo, error) {
+	opts := minio.StatObjectOptions{Checksum: true}
+	info, err := client.StatObject(ctx, bucket, key, opts)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, &rs.CorruptReferenceError{
+				Code: rs.StatusFileNotFound,
+				Err:  err,
+			}
+		}
+		return nil, oops.Wrapf(err, "failed to stat object %s", key)
+	}
+
+	return &rs.ObjectInfo{
+		Size:      uint64(info.Size),
+		ETag:      info.ETag,
+		VersionID: info.VersionID,
+		Checksum:  checksum(info),
+	}, nil
+}
+
+// checksum returns the strongest checksum S3 stored for the object.
+func checksum(info minio.ObjectInfo) string {
+	switch {
+	case info.ChecksumSHA256 != "":
+		return "sha256:" + info.ChecksumSHA256
+	case info.ChecksumSHA1 != "":
+		return "sha1:" + info.ChecksumSHA1
+	case info.ChecksumCRC64NVME != "":
+		return "crc64nvme:" + info.ChecksumCRC64NVME
+	case info.ChecksumCRC32C != "":
+		return "crc32c:" + info.ChecksumCRC32C
+	case info.ChecksumCRC32 != "":
+		return "crc32:" + info.ChecksumCRC32
+	default:
+		return ""
+	}
+}
+
+// list calls fn with the keys of the objects of bucket starting with prefix,
+// skipping the folder markers.
+func list(ctx context.Context, client *minio.Client, bucket, prefix string, fn func(key string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for obj := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return oops.Wrapf(obj.Err, "failed to list objects %s", prefix)
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		if err := fn(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -150,6 +150,19 @@ func TestRemoteStore_Duplicate(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, objects[0].Key, pbobj.FilePath)
 	}
+
+	locs, err := rm.Locations(ctx, objects[1].Cid)
+	assert.NoError(t, err)
+	assert.Equal(t, []remotestore.Location{
+		{Key: objects[0].Key, Offset: 0, Size: uint64(chunk.DefaultBlockSize)},
+		{Key: objects[1].Key, Offset: 0, Size: uint64(chunk.DefaultBlockSize)},
+	}, locs)
+
+	_, err = rm.RemoveByKey(ctx, objects[0].Key)
+	assert.NoError(t, err)
+	blk, err := rm.Get(ctx, objects[1].Cid)
+	assert.NoError(t, err)
+	assert.Equal(t, objects[1].Value, blk.RawData())
 }
 
 func TestRemoteStore_Mount(t *testing.T) {
@@ -241,6 +254,133 @@ func TestRemoteStore_Mount(t *testing.T) {
 	}
 }
 
+func TestRemoteStore_MultiBucket(t *testing.T) {
+	objects1 := []object{
+		{"multi", bytes.Repeat([]byte("A"), 1024), cid.MustParse("bafkreidkw4xoxhtxwb2ubcl6bsgw2i7mr3xq7db2i7q3h5hjgrb5su3l5u")},
+	}
+	err := createFiles(t, minioAddr, bucket1, objects1)
+	require.NoError(t, err)
+
+	objects2 := []object{
+		{
+			Key: "multi",
+			Value: slices.Concat(
+				bytes.Repeat([]byte("A"), int(chunk.DefaultBlockSize)),
+				bytes.Repeat([]byte("B"), 200),
+			),
+			Cid: cid.MustParse("QmU36W4ktZDYDGutmTaakCCuQVTFXhsdcQfNHPxhYW5EUM"),
+		},
+	}
+	err = createFiles(t, minioAddr, bucket2, objects2)
+	require.NoError(t, err)
+
+	mc, err := newClient(minioAddr)
+	require.NoError(t, err)
+
+	resolved := map[string]int{}
+	datastore := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := blockstore.NewBlockstore(datastore)
+	s3s := s3.NewMulti(nil, s3.WithResolver(func(ctx context.Context, bucket string) (*minio.Client, error) {
+		resolved[bucket]++
+		return mc, nil
+	}))
+	rm := remotestore.NewRemoteManager(datastore, s3s)
+	rs := remotestore.NewRemotestore(bs, rm)
+
+	ctx := context.Background()
+
+	files := []struct {
+		Key   string
+		Value []byte
+		Cid   cid.Cid
+	}{
+		{Key: s3.JoinKey(bucket1, "multi"), Value: objects1[0].Value, Cid: objects1[0].Cid},
+		{Key: "s3://" + s3.JoinKey(bucket2, "multi"), Value: objects2[0].Value, Cid: objects2[0].Cid},
+	}
+
+	for _, f := range files {
+		node, err := rs.SyncIndex(ctx, f.Key, remotestore.SyncIndexOptions{})
+		require.NoError(t, err)
+		assert.Equalf(t, f.Cid, node.Cid(), "cid mismatch %s", node.Cid().String())
+	}
+
+	block, err := rs.Get(ctx, objects1[0].Cid)
+	require.NoError(t, err)
+	assert.Equal(t, objects1[0].Value, block.RawData())
+
+	assert.Equal(t, map[string]int{bucket1: 1, bucket2: 1}, resolved)
+
+	_, err = rs.SyncIndex(ctx, "no-bucket", remotestore.SyncIndexOptions{})
+	assert.Error(t, err)
+}
+
+func TestRemoteStore_VerifyAllObjects(t *testing.T) {
+	value := slices.Concat(
+		bytes.Repeat([]byte("A"), int(chunk.DefaultBlockSize)),
+		bytes.Repeat([]byte("D"), 200),
+	)
+	objects := []object{
+		{Key: "verify/changed", Value: value},
+		{Key: "verify/deleted", Value: bytes.Repeat([]byte("E"), 1024)},
+		{Key: "verify/same", Value: bytes.Repeat([]byte("F"), 1024)},
+	}
+	err := createFiles(t, minioAddr, bucket1, objects)
+	require.NoError(t, err)
+
+	mc, err := newClient(minioAddr)
+	require.NoError(t, err)
+
+	datastore := dssync.MutexWrap(ds.NewMapDatastore())
+	bs := blockstore.NewBlockstore(datastore)
+	rm := remotestore.NewRemoteManager(datastore, s3.New(mc, bucket1))
+	rs := remotestore.NewRemotestore(bs, rm)
+
+	ctx := context.Background()
+
+	for _, obj := range objects {
+		_, err := rs.SyncIndex(ctx, obj.Key, remotestore.SyncIndexOptions{})
+		require.NoError(t, err)
+
+		info, err := rm.ObjectInfo(ctx, obj.Key)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(len(obj.Value)), info.Size)
+		assert.NotEmpty(t, info.ETag)
+	}
+
+	// keep the first block, change the second one
+	changed := slices.Concat(
+		bytes.Repeat([]byte("A"), int(chunk.DefaultBlockSize)),
+		bytes.Repeat([]byte("G"), 200),
+	)
+	err = createFiles(t, minioAddr, bucket1, []object{{Key: "verify/changed", Value: changed}})
+	require.NoError(t, err)
+	err = mc.RemoveObject(ctx, bucket1, "verify/deleted", minio.RemoveObjectOptions{})
+	require.NoError(t, err)
+
+	collect := func(recheckChanged bool) map[string][]remotestore.Status {
+		next, err := remotestore.VerifyAllObjects(ctx, rs, recheckChanged)
+		require.NoError(t, err)
+
+		out := map[string][]remotestore.Status{}
+		for r := next(ctx); r != nil; r = next(ctx) {
+			out[r.FilePath] = append(out[r.FilePath], r.Status)
+		}
+		return out
+	}
+
+	assert.Equal(t, map[string][]remotestore.Status{
+		"verify/changed": {remotestore.StatusFileChanged, remotestore.StatusFileChanged},
+		"verify/deleted": {remotestore.StatusFileNotFound},
+		"verify/same":    {remotestore.StatusOk},
+	}, collect(false))
+
+	assert.Equal(t, map[string][]remotestore.Status{
+		"verify/changed": {remotestore.StatusOk, remotestore.StatusFileChanged},
+		"verify/deleted": {remotestore.StatusFileNotFound},
+		"verify/same":    {remotestore.StatusOk},
+	}, collect(true))
+}
+
 func TestMain(m *testing.M) {
 	addr, cleanup, err := createMinio()
 	if err != nil {
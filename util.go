@@ -2,16 +2,19 @@ package remotestore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"sort"
 	"time"
 
 	dshelp "github.com/ipfs/boxo/datastore/dshelp"
 	"github.com/ipfs/boxo/files"
 	pb "github.com/ipfs/boxo/filestore/pb"
+	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
@@ -142,6 +145,25 @@ func Verify(ctx context.Context, fs *Remotestore, key cid.Cid) *ListRes {
 	return list(ctx, fs, true, key.Hash())
 }
 
+// VerifyObject is like Verify, but trusts the fingerprint recorded when the
+// file of the block was indexed: the block data is only read if the file has
+// no recorded fingerprint or its source cannot stat it.
+func VerifyObject(ctx context.Context, fs *Remotestore, key cid.Cid) *ListRes {
+	dobj, err := fs.fm.getDataObj(ctx, key.Hash())
+	if err != nil {
+		return mkListRes(key.Hash(), nil, err)
+	}
+
+	check := fs.fm.checkObject(ctx, dobj.GetFilePath(), false)
+	switch {
+	case check.verify:
+		_, err = fs.fm.readDataObj(ctx, key.Hash(), dobj)
+	case check.err != nil:
+		err = check.err
+	}
+	return mkListRes(key.Hash(), dobj, err)
+}
+
 // VerifyAll returns a function as an iterator which, once invoked,
 // returns one by one each block in the Filestore's FileManager.
 // VerifyAll checks that the reference is valid and that the block data
@@ -153,6 +175,46 @@ func VerifyAll(ctx context.Context, fs *Remotestore, fileOrder bool) (func(conte
 	return listAll(ctx, fs, true)
 }
 
+// VerifyAllObjects is like VerifyAll, but checks each distinct file only once
+// against the fingerprint recorded when it was indexed, and reports the result
+// for all the references of that file at once. The block data is only read
+// for files without a recorded fingerprint, files whose source cannot stat
+// them and, if recheckChanged is set, files which changed, so that the
+// references still matching the new content are not reported as changed.
+// Results are returned in file order.
+func VerifyAllObjects(ctx context.Context, fs *Remotestore, recheckChanged bool) (func(context.Context) *ListRes, error) {
+	entries, err := listEntriesFileOrder(ctx, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var check *objectCheck
+	i := 0
+	return func(ctx context.Context) *ListRes {
+		if i >= len(entries) {
+			return nil
+		}
+		v := entries[i]
+		i++
+		mhash, dobj, err := v.dataObj()
+		if err != nil {
+			return mkListRes(mhash, dobj, err)
+		}
+
+		if check == nil || check.path != v.filePath {
+			check = fs.fm.checkObject(ctx, v.filePath, recheckChanged)
+		}
+
+		switch {
+		case check.verify:
+			_, err = fs.fm.readDataObj(ctx, mhash, dobj)
+		case check.err != nil:
+			err = check.err
+		}
+		return mkListRes(mhash, dobj, err)
+	}, nil
+}
+
 func IsRawNodeCid(c cid.Cid) bool {
 	return c.Type() == cid.Raw
 }
@@ -207,11 +269,90 @@ func next(qr dsq.Results) (mh.Multihash, *pb.DataObj, error) {
 }
 
 func listAllFileOrder(ctx context.Context, fs *Remotestore, verify bool) (func(context.Context) *ListRes, error) {
+	entries, err := listEntriesFileOrder(ctx, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	i := 0
+	return func(ctx context.Context) *ListRes {
+		if i >= len(entries) {
+			return nil
+		}
+		v := entries[i]
+		i++
+		mhash, dobj, err := v.dataObj()
+		// finally verify the dataobj if requested
+		if err == nil && verify {
+			_, err = fs.fm.readDataObj(ctx, mhash, dobj)
+		}
+		return mkListRes(mhash, dobj, err)
+	}, nil
+}
+
+type objectCheck struct {
+	path   string
+	verify bool
+	err    error
+}
+
+// checkObject compares the object at path with its recorded fingerprint.
+func (f *RemoteManager) checkObject(ctx context.Context, path string, recheckChanged bool) *objectCheck {
+	check := &objectCheck{path: path, verify: true}
+
+	ss, ok := f.source.(StatSource)
+	if !ok {
+		return check
+	}
+
+	recorded, err := f.ObjectInfo(ctx, path)
+	if err != nil {
+		if err != ds.ErrNotFound {
+			logger.Errorf("reading object info of %s: %s", path, err)
+		}
+		return check
+	}
+
+	info, err := ss.Stat(ctx, filepath.FromSlash(path))
+	switch {
+	case errors.Is(err, ErrNotSupported):
+		return check
+	case err != nil:
+		var cerr *CorruptReferenceError
+		if !errors.As(err, &cerr) {
+			cerr = &CorruptReferenceError{StatusFileError, err}
+		}
+		check.verify = false
+		check.err = cerr
+		return check
+	}
+
+	if !recorded.HasFingerprint() {
+		return check
+	}
+
+	if !recorded.Matches(info) {
+		if !recheckChanged {
+			check.verify = false
+			check.err = &CorruptReferenceError{
+				StatusFileChanged,
+				fmt.Errorf("object %s changed since it was indexed", path),
+			}
+		}
+		return check
+	}
+
+	check.verify = false
+	return check
+}
+
+func listEntriesFileOrder(ctx context.Context, fs *Remotestore) (listEntries, error) {
 	q := dsq.Query{}
 	qr, err := fs.fm.ds.Query(ctx, q)
 	if err != nil {
 		return nil, err
 	}
+	defer qr.Close()
 
 	var entries listEntries
 
@@ -237,38 +378,7 @@ func listAllFileOrder(ctx context.Context, fs *Remotestore, verify bool) (func(c
 	}
 	sort.Sort(entries)
 
-	i := 0
-	return func(ctx context.Context) *ListRes {
-		if i >= len(entries) {
-			return nil
-		}
-		v := entries[i]
-		i++
-		// attempt to convert the datastore key to a Multihash,
-		// store the error but don't use it yet
-		mhash, keyErr := dshelp.DsKeyToMultihash(ds.RawKey(v.dsKey))
-		// first if they listRes already had an error return that error
-		if v.err != nil {
-			return mkListRes(mhash, nil, v.err)
-		}
-		// now reconstruct the DataObj
-		dobj := pb.DataObj{
-			FilePath: &v.filePath,
-			Offset:   &v.offset,
-			Size:     &v.size,
-		}
-		// now if we could not convert the datastore key return that
-		// error
-		if keyErr != nil {
-			return mkListRes(mhash, &dobj, keyErr)
-		}
-		// finally verify the dataobj if requested
-		var err error
-		if verify {
-			_, err = fs.fm.readDataObj(ctx, mhash, &dobj)
-		}
-		return mkListRes(mhash, &dobj, err)
-	}, nil
+	return entries, nil
 }
 
 type listEntry struct {
@@ -279,6 +389,26 @@ type listEntry struct {
 	err      error
 }
 
+// dataObj reconstructs the multihash and the DataObj of the entry.
+func (v *listEntry) dataObj() (mh.Multihash, *pb.DataObj, error) {
+	// attempt to convert the datastore key to a Multihash,
+	// store the error but don't use it yet
+	mhash, keyErr := dshelp.DsKeyToMultihash(ds.RawKey(v.dsKey))
+	// first if they listRes already had an error return that error
+	if v.err != nil {
+		return mhash, nil, v.err
+	}
+	// now reconstruct the DataObj
+	dobj := &pb.DataObj{
+		FilePath: &v.filePath,
+		Offset:   &v.offset,
+		Size:     &v.size,
+	}
+	// now if we could not convert the datastore key return that
+	// error
+	return mhash, dobj, keyErr
+}
+
 type listEntries []*listEntry
 
 func (l listEntries) Len() int      { return len(l) }
@@ -326,3 +456,17 @@ func mkListRes(m mh.Multihash, d *pb.DataObj, err error) *ListRes {
 		Offset:   *d.Offset,
 	}
 }
+
+// identityBlock returns the block inlined in c, if c has the identity
+// hash.
+func identityBlock(c cid.Cid) (blocks.Block, bool) {
+	if c.Prefix().MhType != mh.IDENTITY {
+		return nil, false
+	}
+	dmh, err := mh.Decode(c.Hash())
+	if err != nil {
+		return nil, false
+	}
+	b, err := blocks.NewBlockWithCid(dmh.Digest, c)
+	return b, err == nil
+}